@@ -5,20 +5,40 @@ import (
 	"sync"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
-
 )
 
 type kubeBackend struct {
 	*framework.Backend
 	testMode bool
-	saMutex sync.RWMutex
+	// saLocks guard changes of bindings, a binding is locked by its name. Issuing credentials only reads bindings, so
+	// it doesn't lock them while talking to Kubernetes.
+	saLocks []*locksutil.LockEntry
+	// configMutex serializes changes of config, including token rotation
+	configMutex sync.Mutex
+
+	clientsMutex sync.RWMutex
+	// clients are cached by storage key of the connection
+	clients map[string]*cachedClient
+
+	mountIDMutex sync.Mutex
+	mountID      string
+
+	// tidyRunning is 1 while tidy is in progress
+	tidyRunning     uint32
+	tidyStatusMutex sync.Mutex
+	tidyStatus      *tidyStatus
 }
 
 // New creates and returns new instance of Kubernetes secrets manager backend
 func New() *kubeBackend {
 	var b kubeBackend
+	b.saLocks = locksutil.CreateLocks()
+	b.clients = map[string]*cachedClient{}
 
 	b.Backend = &framework.Backend{
 		BackendType: logical.TypeLogical,
@@ -26,14 +46,25 @@ func New() *kubeBackend {
 		PathsSpecial: &logical.Paths{
 			Unauthenticated: []string{"login"},
 		},
+		Invalidate:        b.invalidate,
 		WALRollback:       b.walRollback,
 		WALRollbackMinAge: 5 * time.Minute,
+		PeriodicFunc:      b.periodicFunc,
 		Paths: []*framework.Path{
 			pathConfig(&b),
 			pathServiceAccounts(&b),
 			pathServiceAccountsList(&b),
+			pathServiceAccountPermissions(&b),
 			pathSecrets(&b),
-			// TODO P1 pathConfigRotateToken
+			pathCreds(&b),
+			pathConfigRotateRoot(&b),
+			pathClusters(&b),
+			pathClustersList(&b),
+			pathClustersRotateRoot(&b),
+			pathTidy(&b),
+			pathTidyStatus(&b),
+			pathRevocationsPending(&b),
+			pathRevocationsPendingEntry(&b),
 		},
 		Secrets: []*framework.Secret{
 			secretAccessTokens(&b),
@@ -45,6 +76,33 @@ func New() *kubeBackend {
 	return &b
 }
 
+// writesReplicatedStorage reports whether this node is the active node of the primary cluster, or the mount is local.
+// Elsewhere storage of the mount is read-only, so objects created in Kubernetes couldn't be recorded.
+func (b *kubeBackend) writesReplicatedStorage() bool {
+	state := b.System().ReplicationState()
+	if state.HasState(consts.ReplicationDRSecondary | consts.ReplicationPerformanceStandby) {
+		return false
+	}
+	return b.System().LocalMount() || !state.HasState(consts.ReplicationPerformanceSecondary)
+}
+
+// periodicFunc is invoked by Vault about once a minute
+func (b *kubeBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	// Rotation creates a token Secret before storing it in config and retried revocations update the queue, both only
+	// run where storage can be written. Leases and the queue are replicated, the primary retries revocations for all.
+	if !b.writesReplicatedStorage() {
+		return nil
+	}
+	var result error
+	if err := b.rotateRootTokensIfDue(ctx, req.Storage); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := b.retryRevocations(ctx, req.Storage, time.Now()); err != nil {
+		result = multierror.Append(result, err)
+	}
+	return result
+}
+
 // Factory creates and returns new backend with BackendConfig
 func Factory(ctx context.Context, c *logical.BackendConfig) (logical.Backend, error) {
 	b := New()
@@ -2,6 +2,10 @@ package backend
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -32,6 +36,19 @@ func getTestBackend(t *testing.T) (logical.Backend, logical.Storage) {
 	return b, c.StorageView
 }
 
+// newTestKubeServer starts fake Kubernetes API server answering with handler and returns connection to it
+func newTestKubeServer(t *testing.T, handler http.Handler) *config {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	return &config{
+		Token:  "123qwe",
+		APIURL: server.URL,
+		CA:     base64.StdEncoding.EncodeToString(ca),
+	}
+}
+
 func assertNoErrorRequest(t *testing.T, b logical.Backend, r *logical.Request) *logical.Response {
 	resp, err := b.HandleRequest(context.Background(), r)
 	if err != nil {
@@ -0,0 +1,184 @@
+package backend
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	certificateSigningRequestWALKind = "certificate-signing-request"
+
+	// clientCertificateSignerName signs client certificates trusted by kube-apiserver, its requests are never approved
+	// automatically
+	clientCertificateSignerName = "kubernetes.io/kube-apiserver-client"
+)
+
+type walCertificateSigningRequest struct {
+	Name    string
+	Cluster string
+	APIURL  string
+}
+
+// createCertificate generates a key pair and gets a client certificate for sa.UserName and sa.Groups signed by the
+// cluster. The plugin approves its own CertificateSigningRequest, so it needs the approve permission for the signer.
+// Kubernetes can't revoke the certificate, it stays valid until it expires after ttl (but not earlier than
+// minTokenExpiration). The CertificateSigningRequest object is deleted on revoke.
+func (b *kubeBackend) createCertificate(ctx context.Context, s logical.Storage, c *config, sa *ServiceAccount, ttl time.Duration, p *provenance) (*issuedToken, error) {
+	if ttl < minTokenExpiration {
+		ttl = minTokenExpiration
+	}
+	expirationSeconds := int32(ttl.Seconds())
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errwrap.Wrapf("Unable to generate private key, {{err}}", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, errwrap.Wrapf("Unable to encode private key, {{err}}", err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   sa.UserName,
+			Organization: sa.Groups,
+		},
+	}, key)
+	if err != nil {
+		return nil, errwrap.Wrapf("Unable to create certificate request, {{err}}", err)
+	}
+
+	name := dynamicObjectName(sa.Name)
+	csr := &certificatesv1.CertificateSigningRequest{
+		ObjectMeta: p.objectMeta(name, nil),
+		Spec: certificatesv1.CertificateSigningRequestSpec{
+			Request:           pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}),
+			SignerName:        clientCertificateSignerName,
+			ExpirationSeconds: &expirationSeconds,
+			Usages: []certificatesv1.KeyUsage{
+				certificatesv1.UsageDigitalSignature,
+				certificatesv1.UsageKeyEncipherment,
+				certificatesv1.UsageClientAuth,
+			},
+		},
+	}
+
+	walID, err := framework.PutWAL(ctx, s, certificateSigningRequestWALKind, &walCertificateSigningRequest{
+		Name:    name,
+		Cluster: sa.Cluster,
+		APIURL:  c.APIURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var certificate []byte
+	var CABase64 interface{}
+	expiration := time.Now().Add(ttl)
+
+	if !b.testMode {
+		clientSet, err := b.clientSet(sa.Cluster, c)
+		if err != nil {
+			return nil, err
+		}
+		timeout, err := getTokenWaitTimeout(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		csr, err = clientSet.CertificatesV1().CertificateSigningRequests().Create(ctx, csr, metav1.CreateOptions{})
+		if err != nil {
+			return nil, errwrap.Wrapf("Unable to create CertificateSigningRequest, {{err}}", err)
+		}
+		csr.Status.Conditions = append(csr.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
+			Type:    certificatesv1.CertificateApproved,
+			Status:  v1.ConditionTrue,
+			Reason:  "VaultApproved",
+			Message: fmt.Sprintf("Issued by Vault for binding '%s'", sa.Name),
+		})
+		_, err = clientSet.CertificatesV1().CertificateSigningRequests().UpdateApproval(ctx, name, csr, metav1.UpdateOptions{})
+		if err != nil {
+			return nil, errwrap.Wrapf("Unable to approve CertificateSigningRequest, {{err}}", err)
+		}
+		certificate, err = waitForCertificate(ctx, clientSet, name, timeout)
+		if err != nil {
+			b.rollbackNow(s, walID, func(ctx context.Context) error {
+				return clientSet.CertificatesV1().CertificateSigningRequests().Delete(ctx, name, metav1.DeleteOptions{})
+			})
+			return nil, err
+		}
+		if cert, err := parseCertificate(certificate); err == nil {
+			expiration = cert.NotAfter
+		}
+		CABase64 = c.CA
+	} else {
+		certificate = []byte("test")
+		CABase64 = "test"
+	}
+
+	return &issuedToken{
+		Data: map[string]interface{}{
+			"certificate": string(certificate),
+			"private_key": string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+			"namespace":   sa.Namespace,
+			"CA_base64":   CABase64,
+		},
+		InternalData: map[string]interface{}{
+			"token-type": tokenTypeCertificate,
+			"csr-name":   name,
+			"expiration": expiration.Unix(),
+		},
+		walIDs: []string{walID},
+	}, nil
+}
+
+// waitForCertificate returns PEM encoded certificate once the signer issued it, the signer does it asynchronously
+// after approval. The request is watched, but not longer than timeout.
+func waitForCertificate(ctx context.Context, clientSet *kubernetes.Clientset, name string, timeout time.Duration) ([]byte, error) {
+	csrs := clientSet.CertificatesV1().CertificateSigningRequests()
+	object, err := waitForObject(ctx, timeout, name, func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+		return csrs.List(ctx, options)
+	}, csrs.Watch, func(object runtime.Object) (bool, error) {
+		csr, ok := object.(*certificatesv1.CertificateSigningRequest)
+		if !ok {
+			return false, nil
+		}
+		for _, condition := range csr.Status.Conditions {
+			if condition.Type == certificatesv1.CertificateDenied || condition.Type == certificatesv1.CertificateFailed {
+				return false, fmt.Errorf("CertificateSigningRequest was not signed: %s %s", condition.Reason, condition.Message)
+			}
+		}
+		return len(csr.Status.Certificate) > 0, nil
+	})
+	if err == errWaitTimeout {
+		return nil, fmt.Errorf("CertificateSigningRequest '%s' was not signed in %s, check that signer '%s' is enabled "+
+			"in kube-controller-manager", name, timeout, clientCertificateSignerName)
+	}
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Unable to get certificate of CertificateSigningRequest '%s', {{err}}", name), err)
+	}
+	return object.(*certificatesv1.CertificateSigningRequest).Status.Certificate, nil
+}
+
+func parseCertificate(certificate []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certificate)
+	if block == nil {
+		return nil, errors.New("certificate is not PEM encoded")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
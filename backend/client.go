@@ -1,7 +1,9 @@
 package backend
 
 import (
+	"context"
 	"encoding/base64"
+	"strings"
 
 	"github.com/hashicorp/errwrap"
 
@@ -28,3 +30,57 @@ func getClientSet(c *config) (*kubernetes.Clientset, error) {
 	}
 	return clientset, nil
 }
+
+// cachedClient is a client of a stored connection, it's reused until the connection changes
+type cachedClient struct {
+	apiURL    string
+	ca        string
+	token     string
+	clientSet *kubernetes.Clientset
+}
+
+func (cc *cachedClient) matches(c *config) bool {
+	return cc.apiURL == c.APIURL && cc.ca == c.CA && cc.token == c.Token
+}
+
+// clientSet returns client for connection c of cluster, empty cluster means the default connection from config. The
+// client is cached, so requests share its transport and TLS connections. A cached client built from other connection
+// settings is replaced, even if invalidation was missed.
+func (b *kubeBackend) clientSet(cluster string, c *config) (*kubernetes.Clientset, error) {
+	key := connectionStorageKey(cluster)
+	b.clientsMutex.RLock()
+	cached := b.clients[key]
+	b.clientsMutex.RUnlock()
+	if cached != nil && cached.matches(c) {
+		return cached.clientSet, nil
+	}
+
+	clientSet, err := getClientSet(c)
+	if err != nil {
+		return nil, err
+	}
+	b.clientsMutex.Lock()
+	defer b.clientsMutex.Unlock()
+	b.clients[key] = &cachedClient{
+		apiURL:    c.APIURL,
+		ca:        c.CA,
+		token:     c.Token,
+		clientSet: clientSet,
+	}
+	return clientSet, nil
+}
+
+// invalidateClient drops cached client of connection stored under key
+func (b *kubeBackend) invalidateClient(key string) {
+	b.clientsMutex.Lock()
+	defer b.clientsMutex.Unlock()
+	delete(b.clients, key)
+}
+
+// invalidate is called by Vault when key changes in storage underneath the backend, for example on performance
+// standbys and replicated clusters
+func (b *kubeBackend) invalidate(ctx context.Context, key string) {
+	if key == ConfigStorageKey || strings.HasPrefix(key, clustersStoragePrefix+"/") {
+		b.invalidateClient(key)
+	}
+}
@@ -0,0 +1,56 @@
+package backend
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestClientSetCache(t *testing.T) {
+	b, s := getTestBackend(t)
+	kb := b.(*kubeBackend)
+
+	_, c := newTestAPIServer(t, nil)
+	first, err := kb.clientSet("", c)
+	assertNoError(t, err)
+	second, err := kb.clientSet("", c)
+	assertNoError(t, err)
+	if first != second {
+		t.Errorf("Client of unchanged connection must be reused")
+	}
+
+	other, err := kb.clientSet("us-east1", c)
+	assertNoError(t, err)
+	if other == first {
+		t.Errorf("Clusters must not share clients")
+	}
+
+	changed := *c
+	changed.Token = "456rty"
+	second, err = kb.clientSet("", &changed)
+	assertNoError(t, err)
+	if first == second {
+		t.Errorf("Client must be rebuilt when connection changes")
+	}
+
+	// Replicated change of the connection underneath the backend
+	b.InvalidateKey(context.Background(), clusterStorageKey("us-east1"))
+	if _, ok := kb.clients[clusterStorageKey("us-east1")]; ok {
+		t.Errorf("Invalidated client must be dropped")
+	}
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"api-url": "https://localhost:8443",
+			"token":   "123qwe",
+			"CA":      "aGVsbG8K",
+		},
+		Storage: s,
+	})
+	if _, ok := kb.clients[ConfigStorageKey]; ok {
+		t.Errorf("Client must be dropped when config is written")
+	}
+}
@@ -0,0 +1,182 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	dynamicServiceAccountWALKind = "dynamic-service-account"
+)
+
+// dynamicServiceAccount describes objects created in Kubernetes for a single lease of a dynamic binding. Role is
+// empty when the binding references an existing ClusterRole.
+type dynamicServiceAccount struct {
+	// Cluster and APIURL are stored only in the WAL entry, leases keep them with the rest of the token data
+	Cluster            string
+	APIURL             string
+	Namespace          string
+	ServiceAccountName string
+	RoleName           string
+	RoleBindingName    string
+	ClusterScoped      bool
+}
+
+func (d *dynamicServiceAccount) toInternalData(data map[string]interface{}) {
+	data["dynamic-service-account-name"] = d.ServiceAccountName
+	data["dynamic-namespace"] = d.Namespace
+	data["dynamic-role-name"] = d.RoleName
+	data["dynamic-role-binding-name"] = d.RoleBindingName
+	data["dynamic-cluster-scoped"] = d.ClusterScoped
+}
+
+// dynamicServiceAccountFromInternalData returns nil if lease was issued for an existing ServiceAccount
+func dynamicServiceAccountFromInternalData(data map[string]interface{}) *dynamicServiceAccount {
+	name, ok := data["dynamic-service-account-name"].(string)
+	if !ok || name == "" {
+		return nil
+	}
+	d := &dynamicServiceAccount{
+		ServiceAccountName: name,
+	}
+	d.Namespace, _ = data["dynamic-namespace"].(string)
+	d.RoleName, _ = data["dynamic-role-name"].(string)
+	d.RoleBindingName, _ = data["dynamic-role-binding-name"].(string)
+	d.ClusterScoped, _ = data["dynamic-cluster-scoped"].(bool)
+	return d
+}
+
+// dynamicObjectName returns unique Kubernetes object name for a binding, binding names may contain symbols which are
+// not allowed in Kubernetes names
+func dynamicObjectName(bindingName string) string {
+	name := strings.NewReplacer("_", "-", ".", "-").Replace(strings.ToLower(bindingName))
+	return fmt.Sprintf("%s-%s-%s", secretPrefix, name, generatePostfix(8))
+}
+
+// createDynamicServiceAccount creates ServiceAccount, Role (or ClusterRole) and a binding between them for the
+// dynamic binding sa. All created objects are written to the WAL first, the caller must delete the returned WAL
+// entry once the lease is ready to be returned.
+func (b *kubeBackend) createDynamicServiceAccount(ctx context.Context, s logical.Storage, c *config, sa *ServiceAccount, p *provenance) (*dynamicServiceAccount, string, error) {
+	name := dynamicObjectName(sa.Name)
+	dynamic := &dynamicServiceAccount{
+		Cluster:            sa.Cluster,
+		APIURL:             c.APIURL,
+		Namespace:          sa.Namespace,
+		ServiceAccountName: name,
+		RoleBindingName:    name,
+		ClusterScoped:      sa.ClusterScoped,
+	}
+	if sa.ClusterRole == "" {
+		dynamic.RoleName = name
+	}
+
+	walID, err := framework.PutWAL(ctx, s, dynamicServiceAccountWALKind, dynamic)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if b.testMode {
+		return dynamic, walID, nil
+	}
+
+	clientSet, err := b.clientSet(sa.Cluster, c)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = clientSet.CoreV1().ServiceAccounts(sa.Namespace).Create(ctx, &v1.ServiceAccount{
+		ObjectMeta: p.objectMeta(name, nil),
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, "", errwrap.Wrapf("Unable to create ServiceAccount, {{err}}", err)
+	}
+
+	roleRef := rbacv1.RoleRef{
+		APIGroup: rbacv1.GroupName,
+		Kind:     "ClusterRole",
+		Name:     sa.ClusterRole,
+	}
+	if dynamic.RoleName != "" {
+		roleRef.Name = dynamic.RoleName
+		if sa.ClusterScoped {
+			_, err = clientSet.RbacV1().ClusterRoles().Create(ctx, &rbacv1.ClusterRole{
+				ObjectMeta: p.objectMeta(dynamic.RoleName, nil),
+				Rules:      sa.Rules,
+			}, metav1.CreateOptions{})
+		} else {
+			roleRef.Kind = "Role"
+			_, err = clientSet.RbacV1().Roles(sa.Namespace).Create(ctx, &rbacv1.Role{
+				ObjectMeta: p.objectMeta(dynamic.RoleName, nil),
+				Rules:      sa.Rules,
+			}, metav1.CreateOptions{})
+		}
+		if err != nil {
+			return nil, "", errwrap.Wrapf("Unable to create Role, {{err}}", err)
+		}
+	}
+
+	subjects := []rbacv1.Subject{{
+		Kind:      rbacv1.ServiceAccountKind,
+		Name:      name,
+		Namespace: sa.Namespace,
+	}}
+	if sa.ClusterScoped {
+		_, err = clientSet.RbacV1().ClusterRoleBindings().Create(ctx, &rbacv1.ClusterRoleBinding{
+			ObjectMeta: p.objectMeta(dynamic.RoleBindingName, nil),
+			Subjects:   subjects,
+			RoleRef:    roleRef,
+		}, metav1.CreateOptions{})
+	} else {
+		_, err = clientSet.RbacV1().RoleBindings(sa.Namespace).Create(ctx, &rbacv1.RoleBinding{
+			ObjectMeta: p.objectMeta(dynamic.RoleBindingName, nil),
+			Subjects:   subjects,
+			RoleRef:    roleRef,
+		}, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return nil, "", errwrap.Wrapf("Unable to create RoleBinding, {{err}}", err)
+	}
+
+	return dynamic, walID, nil
+}
+
+// deleteDynamicServiceAccount removes all objects of the dynamic ServiceAccount, objects which are already gone are
+// skipped, so it is safe to call it for partially created ServiceAccount
+func deleteDynamicServiceAccount(ctx context.Context, clientSet *kubernetes.Clientset, d *dynamicServiceAccount) error {
+	var err error
+	if d.ClusterScoped {
+		err = clientSet.RbacV1().ClusterRoleBindings().Delete(ctx, d.RoleBindingName, metav1.DeleteOptions{})
+	} else {
+		err = clientSet.RbacV1().RoleBindings(d.Namespace).Delete(ctx, d.RoleBindingName, metav1.DeleteOptions{})
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return errwrap.Wrapf("Unable to delete RoleBinding, {{err}}", err)
+	}
+
+	if d.RoleName != "" {
+		if d.ClusterScoped {
+			err = clientSet.RbacV1().ClusterRoles().Delete(ctx, d.RoleName, metav1.DeleteOptions{})
+		} else {
+			err = clientSet.RbacV1().Roles(d.Namespace).Delete(ctx, d.RoleName, metav1.DeleteOptions{})
+		}
+		if err != nil && !errors.IsNotFound(err) {
+			return errwrap.Wrapf("Unable to delete Role, {{err}}", err)
+		}
+	}
+
+	err = clientSet.CoreV1().ServiceAccounts(d.Namespace).Delete(ctx, d.ServiceAccountName, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return errwrap.Wrapf("Unable to delete ServiceAccount, {{err}}", err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/logical"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// fanOutTarget is a single cluster a fan-out binding issues a token in
+type fanOutTarget struct {
+	// sa is a copy of the binding pointing to the cluster
+	sa   *ServiceAccount
+	conn *config
+}
+
+// fanOutTargets resolves clusters the binding sa issues tokens in, sorted by name. Binding without clusters and
+// cluster-selector has a single target, which is its cluster (or the default connection).
+func fanOutTargets(ctx context.Context, s logical.Storage, sa *ServiceAccount) ([]fanOutTarget, *logical.Response, error) {
+	if !sa.fanOut() {
+		conn, err := getConnection(ctx, s, sa.Cluster)
+		if err != nil {
+			return nil, nil, err
+		}
+		if conn == nil {
+			if sa.Cluster != "" {
+				return nil, logical.ErrorResponse(fmt.Sprintf("Cluster '%s' not found", sa.Cluster)), nil
+			}
+			return nil, logical.ErrorResponse("Please configure plugin with 'config' path"), nil
+		}
+		return []fanOutTarget{{sa: sa, conn: conn}}, nil, nil
+	}
+
+	names := sa.Clusters
+	if sa.ClusterSelector != "" {
+		selector, err := labels.Parse(sa.ClusterSelector)
+		if err != nil {
+			return nil, logical.ErrorResponse(fmt.Sprintf("cluster-selector is invalid: %s", err)), nil
+		}
+		clusters, err := s.List(ctx, fmt.Sprintf("%s/", clustersStoragePrefix))
+		if err != nil {
+			return nil, nil, err
+		}
+		names = nil
+		for _, name := range clusters {
+			conn, err := getConnection(ctx, s, name)
+			if err != nil {
+				return nil, nil, err
+			}
+			if conn != nil && selector.Matches(labels.Set(conn.Labels)) {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return nil, logical.ErrorResponse(fmt.Sprintf("No cluster matches cluster-selector '%s'", sa.ClusterSelector)), nil
+		}
+	}
+
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+
+	targets := make([]fanOutTarget, 0, len(names))
+	for _, name := range names {
+		conn, err := getConnection(ctx, s, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if conn == nil {
+			return nil, logical.ErrorResponse(fmt.Sprintf("Cluster '%s' not found", name)), nil
+		}
+		target := *sa
+		target.Cluster = name
+		target.Clusters = nil
+		target.ClusterSelector = ""
+		targets = append(targets, fanOutTarget{sa: &target, conn: conn})
+	}
+	return targets, nil, nil
+}
+
+// issueTokens issues tokens in all targets concurrently. Either every token is issued, or the ones which succeeded are
+// revoked again and an error describing all failures is returned. WAL entries of failed tokens are left in place, so
+// anything they created is rolled back later. WAL entries of returned tokens are left uncommitted.
+func (b *kubeBackend) issueTokens(ctx context.Context, s logical.Storage, targets []fanOutTarget, ttl time.Duration, audiences []string,
+	boundObjectRef *authenticationv1.BoundObjectReference, p *provenance) ([]*issuedToken, error) {
+	tokens := make([]*issuedToken, len(targets))
+	errs := make([]error, len(targets))
+
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], errs[i] = b.issueToken(ctx, s, targets[i].conn, targets[i].sa, ttl, audiences, boundObjectRef, p)
+		}(i)
+	}
+	wg.Wait()
+
+	var result error
+	for i, err := range errs {
+		if err != nil {
+			result = multierror.Append(result, errwrap.Wrapf(fmt.Sprintf("cluster '%s': {{err}}", targets[i].sa.Cluster), err))
+		}
+	}
+	if result == nil {
+		return tokens, nil
+	}
+
+	// The request context may be already cancelled, issued tokens must be revoked anyway
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	for i, token := range tokens {
+		if token == nil {
+			continue
+		}
+		if err := b.revokeToken(cleanupCtx, s, token.InternalData); err != nil {
+			// The WAL entry stays, rollback deletes the token later
+			b.Logger().Warn("unable to revoke token of failed fan-out issuance", "cluster", targets[i].sa.Cluster, "error", err)
+			continue
+		}
+		if err := commitWALs(cleanupCtx, s, token.walIDs); err != nil {
+			b.Logger().Warn("unable to remove WAL entry of revoked token", "cluster", targets[i].sa.Cluster, "error", err)
+		}
+	}
+	return nil, result
+}
+
+// fanOutTokens returns internal data of every token covered by a fan-out lease, nil for a single cluster lease
+func fanOutTokens(internalData map[string]interface{}) []map[string]interface{} {
+	switch raw := internalData["tokens"].(type) {
+	case []map[string]interface{}:
+		return raw
+	case []interface{}:
+		// Lease data passed through storage is decoded from JSON
+		tokens := make([]map[string]interface{}, 0, len(raw))
+		for _, item := range raw {
+			if token, ok := item.(map[string]interface{}); ok {
+				tokens = append(tokens, token)
+			}
+		}
+		return tokens
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,135 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	grantWALKind = "grant"
+
+	subjectKindUser           = rbacv1.UserKind
+	subjectKindGroup          = rbacv1.GroupKind
+	subjectKindServiceAccount = rbacv1.ServiceAccountKind
+)
+
+// grant is a RoleBinding (or ClusterRoleBinding) which gives an existing subject a ClusterRole for the lease duration
+type grant struct {
+	// Cluster and APIURL are stored only in the WAL entry, leases keep them with the rest of the data
+	Cluster         string
+	APIURL          string
+	Namespace       string
+	RoleBindingName string
+	ClusterScoped   bool
+}
+
+func (g *grant) toInternalData(data map[string]interface{}) {
+	data["grant-role-binding-name"] = g.RoleBindingName
+	data["grant-namespace"] = g.Namespace
+	data["grant-cluster-scoped"] = g.ClusterScoped
+}
+
+// grantFromInternalData returns nil if lease doesn't grant a role
+func grantFromInternalData(data map[string]interface{}) *grant {
+	name, ok := data["grant-role-binding-name"].(string)
+	if !ok || name == "" {
+		return nil
+	}
+	g := &grant{
+		RoleBindingName: name,
+	}
+	g.Namespace, _ = data["grant-namespace"].(string)
+	g.ClusterScoped, _ = data["grant-cluster-scoped"].(bool)
+	return g
+}
+
+// createGrant binds sa.ClusterRole to the subject of the grant binding sa. No credential is issued, the subject
+// authenticates to Kubernetes on its own. The WAL entry is returned uncommitted.
+func (b *kubeBackend) createGrant(ctx context.Context, s logical.Storage, c *config, sa *ServiceAccount, p *provenance) (*issuedToken, error) {
+	g := &grant{
+		Cluster:         sa.Cluster,
+		APIURL:          c.APIURL,
+		Namespace:       sa.Namespace,
+		RoleBindingName: dynamicObjectName(sa.Name),
+		ClusterScoped:   sa.ClusterScoped,
+	}
+
+	walID, err := framework.PutWAL(ctx, s, grantWALKind, g)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := rbacv1.Subject{
+		Kind: sa.SubjectKind,
+		Name: sa.SubjectName,
+	}
+	if sa.SubjectKind == subjectKindServiceAccount {
+		subject.Namespace = sa.Namespace
+	} else {
+		subject.APIGroup = rbacv1.GroupName
+	}
+	roleRef := rbacv1.RoleRef{
+		APIGroup: rbacv1.GroupName,
+		Kind:     "ClusterRole",
+		Name:     sa.ClusterRole,
+	}
+
+	if !b.testMode {
+		clientSet, err := b.clientSet(sa.Cluster, c)
+		if err != nil {
+			return nil, err
+		}
+		if g.ClusterScoped {
+			_, err = clientSet.RbacV1().ClusterRoleBindings().Create(ctx, &rbacv1.ClusterRoleBinding{
+				ObjectMeta: p.objectMeta(g.RoleBindingName, nil),
+				Subjects:   []rbacv1.Subject{subject},
+				RoleRef:    roleRef,
+			}, metav1.CreateOptions{})
+		} else {
+			_, err = clientSet.RbacV1().RoleBindings(g.Namespace).Create(ctx, &rbacv1.RoleBinding{
+				ObjectMeta: p.objectMeta(g.RoleBindingName, nil),
+				Subjects:   []rbacv1.Subject{subject},
+				RoleRef:    roleRef,
+			}, metav1.CreateOptions{})
+		}
+		if err != nil {
+			return nil, errwrap.Wrapf("Unable to create RoleBinding, {{err}}", err)
+		}
+	}
+
+	token := &issuedToken{
+		Data: map[string]interface{}{
+			"namespace":         g.Namespace,
+			"role-binding-name": g.RoleBindingName,
+			"cluster-role":      sa.ClusterRole,
+			"subject-kind":      sa.SubjectKind,
+			"subject-name":      sa.SubjectName,
+		},
+		InternalData: map[string]interface{}{},
+		walIDs:       []string{walID},
+	}
+	g.toInternalData(token.InternalData)
+	return token, nil
+}
+
+// deleteGrant removes the binding of the grant, a binding which is already gone is skipped
+func deleteGrant(ctx context.Context, clientSet *kubernetes.Clientset, g *grant) error {
+	var err error
+	if g.ClusterScoped {
+		err = clientSet.RbacV1().ClusterRoleBindings().Delete(ctx, g.RoleBindingName, metav1.DeleteOptions{})
+	} else {
+		err = clientSet.RbacV1().RoleBindings(g.Namespace).Delete(ctx, g.RoleBindingName, metav1.DeleteOptions{})
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return errwrap.Wrapf(fmt.Sprintf("Unable to delete RoleBinding '%s', {{err}}", g.RoleBindingName), err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/helper/identitytpl"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// groupListTemplates expand to all groups of the requesting entity, they can only be used as a whole groups entry
+var groupListTemplates = map[string]string{
+	"{{identity.entity.groups.names}}": "names",
+	"{{identity.groups.names}}":        "names",
+	"{{identity.entity.groups.ids}}":   "ids",
+	"{{identity.groups.ids}}":          "ids",
+}
+
+// validateIdentityTemplate checks that tpl is a valid identity template, plain strings are valid as well
+func validateIdentityTemplate(tpl string) error {
+	if _, ok := groupListTemplates[tpl]; ok {
+		return nil
+	}
+	_, _, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+		String:            tpl,
+		ValidityCheckOnly: true,
+		Mode:              identitytpl.ACLTemplating,
+	})
+	return err
+}
+
+// isIdentityTemplate reports whether value is rendered for the requesting entity
+func isIdentityTemplate(value string) bool {
+	return strings.Contains(value, "{{")
+}
+
+// usesIdentityTemplates reports whether user name, groups, subject name, namespaces or ServiceAccount name of sa depend
+// on the requesting entity
+func (r *ServiceAccount) usesIdentityTemplates() bool {
+	templates := []string{r.UserName, r.SubjectName, r.Namespace, r.ServiceAccountName}
+	templates = append(templates, r.Groups...)
+	templates = append(templates, r.AllowedNamespaces...)
+	for _, tpl := range templates {
+		if isIdentityTemplate(tpl) {
+			return true
+		}
+	}
+	return false
+}
+
+// withIdentity returns a copy of sa with user name, groups, subject name, namespaces and ServiceAccount name rendered
+// for the entity behind req. Bindings without templates are returned as is.
+func (b *kubeBackend) withIdentity(req *logical.Request, sa *ServiceAccount) (*ServiceAccount, *logical.Response, error) {
+	if !sa.usesIdentityTemplates() {
+		return sa, nil, nil
+	}
+	if req.EntityID == "" {
+		return nil, logical.ErrorResponse(fmt.Sprintf("ServiceAccount '%s' uses identity templates, but the request has no entity", sa.Name)), nil
+	}
+
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return nil, nil, errwrap.Wrapf("unable to get entity: {{err}}", err)
+	}
+	if entity == nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("entity '%s' not found", req.EntityID)), nil
+	}
+	groups, err := b.System().GroupsForEntity(req.EntityID)
+	if err != nil {
+		return nil, nil, errwrap.Wrapf("unable to get groups of entity: {{err}}", err)
+	}
+
+	render := func(tpl string) (string, error) {
+		_, result, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+			String: tpl,
+			Entity: entity,
+			Groups: groups,
+			Mode:   identitytpl.ACLTemplating,
+		})
+		return result, err
+	}
+
+	target := *sa
+	if target.UserName, err = render(sa.UserName); err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("unable to render user-name '%s': %s", sa.UserName, err)), nil
+	}
+
+	if target.SubjectName, err = render(sa.SubjectName); err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("unable to render subject-name '%s': %s", sa.SubjectName, err)), nil
+	}
+
+	if target.Namespace, err = render(sa.Namespace); err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("unable to render namespace '%s': %s", sa.Namespace, err)), nil
+	}
+	if target.Namespace != sa.Namespace && target.Namespace != "" && len(validation.IsDNS1123Label(target.Namespace)) > 0 {
+		return nil, logical.ErrorResponse(fmt.Sprintf("namespace '%s' rendered from '%s' is not a valid namespace name", target.Namespace, sa.Namespace)), nil
+	}
+
+	if target.ServiceAccountName, err = render(sa.ServiceAccountName); err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("unable to render service-account-name '%s': %s", sa.ServiceAccountName, err)), nil
+	}
+	if target.ServiceAccountName != sa.ServiceAccountName && target.ServiceAccountName != "" && len(validation.IsDNS1123Subdomain(target.ServiceAccountName)) > 0 {
+		return nil, logical.ErrorResponse(fmt.Sprintf("service-account-name '%s' rendered from '%s' is not a valid ServiceAccount name", target.ServiceAccountName, sa.ServiceAccountName)), nil
+	}
+
+	target.AllowedNamespaces = nil
+	for _, tpl := range sa.AllowedNamespaces {
+		pattern, err := render(tpl)
+		if err != nil {
+			return nil, logical.ErrorResponse(fmt.Sprintf("unable to render allowed-namespaces entry '%s': %s", tpl, err)), nil
+		}
+		// Values of the entity must not widen the glob
+		if strings.Count(pattern, "*") != strings.Count(tpl, "*") {
+			return nil, logical.ErrorResponse(fmt.Sprintf("allowed-namespaces entry '%s' rendered to '%s' with a wildcard", tpl, pattern)), nil
+		}
+		target.AllowedNamespaces = append(target.AllowedNamespaces, pattern)
+	}
+
+	target.Groups = nil
+	for _, tpl := range sa.Groups {
+		var values []string
+		switch groupListTemplates[tpl] {
+		case "names":
+			for _, g := range groups {
+				values = append(values, g.Name)
+			}
+		case "ids":
+			for _, g := range groups {
+				values = append(values, g.ID)
+			}
+		default:
+			group, err := render(tpl)
+			if err != nil {
+				return nil, logical.ErrorResponse(fmt.Sprintf("unable to render group '%s': %s", tpl, err)), nil
+			}
+			values = []string{group}
+		}
+		target.Groups = append(target.Groups, values...)
+	}
+	target.Groups = strutil.RemoveDuplicates(target.Groups, false)
+	return &target, nil, nil
+}
@@ -0,0 +1,152 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"text/template"
+
+	"github.com/hashicorp/errwrap"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	outputFormatDefault        = "default"
+	outputFormatKubeconfig     = "kubeconfig"
+	outputFormatKubeconfigJSON = "kubeconfig-json"
+
+	defaultKubeconfigClusterTemplate = "{{.Host}}"
+	defaultKubeconfigUserTemplate    = "{{.Name}}@{{.Host}}"
+	defaultKubeconfigContextTemplate = "{{.Name}}@{{.Host}}"
+)
+
+// kubeconfigTemplateData is available in cluster, user and context name templates
+type kubeconfigTemplateData struct {
+	// Name of the Vault ServiceAccount binding
+	Name               string
+	Namespace          string
+	ServiceAccountName string
+	// Cluster is the name of cluster connection, empty for the default connection
+	Cluster string
+	// Host of the Kubernetes API server, taken from api-url
+	Host string
+}
+
+// validateKubeconfigTemplate checks that tpl can be used as a kubeconfig name template
+func validateKubeconfigTemplate(tpl string) error {
+	_, err := renderKubeconfigTemplate(tpl, kubeconfigTemplateData{})
+	return err
+}
+
+func renderKubeconfigTemplate(tpl string, data kubeconfigTemplateData) (string, error) {
+	t, err := template.New("kubeconfig").Option("missingkey=error").Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// kubeconfigEntry is a single context of a kubeconfig
+type kubeconfigEntry struct {
+	conn  *config
+	sa    *ServiceAccount
+	token string
+	// clientCertificate and clientKey are PEM encoded, they are used instead of token
+	clientCertificate string
+	clientKey         string
+}
+
+// buildKubeconfig returns a kubeconfig with a context for every entry, which points to conn.APIURL and uses credentials in
+// the ServiceAccount's namespace. The first entry is the current context. Names are rendered with templates from c.
+// format is either outputFormatKubeconfig (YAML) or outputFormatKubeconfigJSON.
+func buildKubeconfig(c *config, entries []kubeconfigEntry, format string) (string, error) {
+	kubeconfig := clientcmdapi.NewConfig()
+	for _, entry := range entries {
+		contextName, err := addKubeconfigContext(kubeconfig, c, entry)
+		if err != nil {
+			return "", err
+		}
+		if kubeconfig.CurrentContext == "" {
+			kubeconfig.CurrentContext = contextName
+		}
+	}
+
+	out, err := clientcmd.Write(*kubeconfig)
+	if err != nil {
+		return "", errwrap.Wrapf("Unable to encode kubeconfig '{{err}}'", err)
+	}
+	switch format {
+	case outputFormatKubeconfig:
+	case outputFormatKubeconfigJSON:
+		if out, err = yaml.YAMLToJSON(out); err != nil {
+			return "", errwrap.Wrapf("Unable to encode kubeconfig '{{err}}'", err)
+		}
+	default:
+		return "", fmt.Errorf("unknown kubeconfig format '%s'", format)
+	}
+	return string(out), nil
+}
+
+// addKubeconfigContext adds cluster, user and context of entry to kubeconfig and returns name of the context
+func addKubeconfigContext(kubeconfig *clientcmdapi.Config, c *config, entry kubeconfigEntry) (string, error) {
+	ca, err := base64.StdEncoding.DecodeString(entry.conn.CA)
+	if err != nil {
+		return "", errwrap.Wrapf("Unable to create kubeconfig, unable to decode CA '{{err}}'", err)
+	}
+
+	apiURL, err := url.Parse(entry.conn.APIURL)
+	if err != nil {
+		return "", errwrap.Wrapf("Unable to create kubeconfig, unable to parse api-url '{{err}}'", err)
+	}
+
+	data := kubeconfigTemplateData{
+		Name:               entry.sa.Name,
+		Namespace:          entry.sa.Namespace,
+		ServiceAccountName: entry.sa.ServiceAccountName,
+		Cluster:            entry.sa.Cluster,
+		Host:               apiURL.Host,
+	}
+	clusterName, err := renderKubeconfigTemplate(c.kubeconfigClusterTemplate(), data)
+	if err != nil {
+		return "", errwrap.Wrapf("Unable to render kubeconfig cluster name '{{err}}'", err)
+	}
+	userName, err := renderKubeconfigTemplate(c.kubeconfigUserTemplate(), data)
+	if err != nil {
+		return "", errwrap.Wrapf("Unable to render kubeconfig user name '{{err}}'", err)
+	}
+	contextName, err := renderKubeconfigTemplate(c.kubeconfigContextTemplate(), data)
+	if err != nil {
+		return "", errwrap.Wrapf("Unable to render kubeconfig context name '{{err}}'", err)
+	}
+	if _, ok := kubeconfig.Contexts[contextName]; ok {
+		return "", fmt.Errorf("Unable to create kubeconfig, context name '%s' is not unique, include .Cluster in kubeconfig-context-name-template", contextName)
+	}
+
+	kubeconfig.Clusters[clusterName] = &clientcmdapi.Cluster{
+		Server:                   entry.conn.APIURL,
+		CertificateAuthorityData: ca,
+	}
+	authInfo := &clientcmdapi.AuthInfo{
+		Token: entry.token,
+	}
+	if entry.clientCertificate != "" {
+		authInfo = &clientcmdapi.AuthInfo{
+			ClientCertificateData: []byte(entry.clientCertificate),
+			ClientKeyData:         []byte(entry.clientKey),
+		}
+	}
+	kubeconfig.AuthInfos[userName] = authInfo
+	kubeconfig.Contexts[contextName] = &clientcmdapi.Context{
+		Cluster:   clusterName,
+		AuthInfo:  userName,
+		Namespace: entry.sa.Namespace,
+	}
+	return contextName, nil
+}
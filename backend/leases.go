@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	mountIDStorageKey   = "mount-id"
+	leasesStoragePrefix = "leases"
+)
+
+// getMountID returns random ID of the mount, it's generated once and kept in storage, so it survives remounts
+func (b *kubeBackend) getMountID(ctx context.Context, s logical.Storage) (string, error) {
+	b.mountIDMutex.Lock()
+	defer b.mountIDMutex.Unlock()
+	if b.mountID != "" {
+		return b.mountID, nil
+	}
+
+	entry, err := s.Get(ctx, mountIDStorageKey)
+	if err != nil {
+		return "", err
+	}
+	if entry != nil {
+		b.mountID = string(entry.Value)
+		return b.mountID, nil
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := s.Put(ctx, &logical.StorageEntry{Key: mountIDStorageKey, Value: []byte(id)}); err != nil {
+		return "", err
+	}
+	b.mountID = id
+	return id, nil
+}
+
+// secretRef identifies ServiceAccount token Secret in a cluster, empty cluster means the default connection
+type secretRef struct {
+	Cluster   string
+	Namespace string
+	Name      string
+}
+
+func (r secretRef) String() string {
+	if r.Cluster == "" {
+		return fmt.Sprintf("%s/%s", r.Namespace, r.Name)
+	}
+	return fmt.Sprintf("%s:%s/%s", r.Cluster, r.Namespace, r.Name)
+}
+
+// leaseRecord is kept in storage while the lease is alive, tidy compares Secrets in clusters against these records
+type leaseRecord struct {
+	ID        string
+	Binding   string
+	IssueTime time.Time
+	Secrets   []secretRef
+	// Clusters hold objects the lease deletes on revocation, records written before it was added only have Secrets
+	Clusters []string
+}
+
+// usesCluster reports whether revocation of the lease needs connection of cluster
+func (r *leaseRecord) usesCluster(cluster string) bool {
+	if strutil.StrListContains(r.Clusters, cluster) {
+		return true
+	}
+	for _, ref := range r.Secrets {
+		if ref.Cluster == cluster {
+			return true
+		}
+	}
+	return false
+}
+
+func leaseStorageKey(id string) string {
+	return fmt.Sprintf("%s/%s", leasesStoragePrefix, id)
+}
+
+// newLeaseRecord describes a lease of binding sa covering tokens
+func newLeaseRecord(sa *ServiceAccount, tokens []*issuedToken) (*leaseRecord, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	record := &leaseRecord{
+		ID:        id,
+		Binding:   sa.Name,
+		IssueTime: time.Now(),
+	}
+	for _, token := range tokens {
+		cluster, _ := token.InternalData["cluster"].(string)
+		if len(revocationObjects(token.InternalData)) > 0 && !strutil.StrListContains(record.Clusters, cluster) {
+			record.Clusters = append(record.Clusters, cluster)
+		}
+		name, _ := token.InternalData["secret-name"].(string)
+		if name == "" {
+			continue
+		}
+		namespace, _ := token.InternalData["namespace"].(string)
+		record.Secrets = append(record.Secrets, secretRef{Cluster: cluster, Namespace: namespace, Name: name})
+	}
+	return record, nil
+}
+
+func putLeaseRecord(ctx context.Context, s logical.Storage, record *leaseRecord) error {
+	entry, err := logical.StorageEntryJSON(leaseStorageKey(record.ID), record)
+	if err != nil {
+		return err
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errwrap.Wrapf("unable to store lease record: {{err}}", err)
+	}
+	return nil
+}
+
+// listLeaseRecords returns records of all live leases
+func listLeaseRecords(ctx context.Context, s logical.Storage) ([]*leaseRecord, error) {
+	ids, err := s.List(ctx, fmt.Sprintf("%s/", leasesStoragePrefix))
+	if err != nil {
+		return nil, err
+	}
+	var records []*leaseRecord
+	for _, id := range ids {
+		entry, err := s.Get(ctx, leaseStorageKey(id))
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		record := &leaseRecord{}
+		if err := entry.DecodeJSON(record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// leaseDataVersion is the version of lease InternalData schema. Version 1 records the connection the lease was issued
+// against (cluster and api-url), leases without version only have cluster.
+const leaseDataVersion = 1
+
+// setConnectionRef records in token's InternalData that it was issued against connection of cluster at apiURL. Empty
+// apiURL comes from WAL entries written by older versions, it's recorded without version.
+func setConnectionRef(data map[string]interface{}, cluster, apiURL string) {
+	data["cluster"] = cluster
+	if apiURL != "" {
+		data["version"] = leaseDataVersion
+		data["api-url"] = apiURL
+	}
+}
+
+// leaseConnection returns cluster and its current connection a token was issued against. Errors are retryable, the
+// connection may be restored later.
+func leaseConnection(ctx context.Context, s logical.Storage, data map[string]interface{}) (string, *config, error) {
+	cluster, _ := data["cluster"].(string)
+	name := fmt.Sprintf("cluster '%s'", cluster)
+	if cluster == "" {
+		name = "config"
+	}
+
+	c, err := getConnection(ctx, s, cluster)
+	if err != nil {
+		return "", nil, err
+	}
+	if c == nil {
+		return "", nil, fmt.Errorf("connection of %s is not configured anymore, revocation will be retried once it's restored", name)
+	}
+
+	if version, _ := internalDataInt64(data["version"]); version >= 1 {
+		apiURL, _ := data["api-url"].(string)
+		if c.APIURL != apiURL {
+			return "", nil, fmt.Errorf("connection of %s points to '%s' now, but the lease was issued against '%s', "+
+				"revocation will be retried once the connection is restored", name, c.APIURL, apiURL)
+		}
+	}
+	return cluster, c, nil
+}
+
+// internalDataInt64 reads a number from InternalData, lease data passed through storage is decoded from JSON
+func internalDataInt64(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), true
+	case json.Number:
+		n, err := v.Int64()
+		return n, err == nil
+	default:
+		return 0, false
+	}
+}
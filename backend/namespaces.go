@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// namespaceRestricted reports whether creds requests may pick namespace of the binding
+func (r *ServiceAccount) namespaceRestricted() bool {
+	return len(r.AllowedNamespaces) > 0 || r.NamespaceSelector != ""
+}
+
+// namespaceMatchesPatterns checks namespace against AllowedNamespaces globs, any namespace matches if there are none.
+// Labels of NamespaceSelector can only be checked in the cluster.
+func (r *ServiceAccount) namespaceMatchesPatterns(namespace string) bool {
+	return len(r.AllowedNamespaces) == 0 || strutil.StrListContainsGlob(r.AllowedNamespaces, namespace)
+}
+
+// resolveNamespace returns namespace the token of binding sa is issued in. requested is the namespace from the creds
+// request, empty means the binding's namespace.
+func resolveNamespace(sa *ServiceAccount, requested string) (string, *logical.Response) {
+	if requested == "" || requested == sa.Namespace {
+		if sa.Namespace == "" {
+			return "", logical.ErrorResponse(fmt.Sprintf("namespace is required, ServiceAccount '%s' has no default namespace", sa.Name))
+		}
+		// Default namespace rendered from an identity template may fall out of allowed-namespaces
+		if !sa.namespaceMatchesPatterns(sa.Namespace) {
+			return "", logical.ErrorResponse(fmt.Sprintf("Namespace '%s' is not allowed for ServiceAccount '%s'", sa.Namespace, sa.Name))
+		}
+		return sa.Namespace, nil
+	}
+	if !sa.namespaceRestricted() {
+		return "", logical.ErrorResponse(fmt.Sprintf("ServiceAccount '%s' is bound to namespace '%s'", sa.Name, sa.Namespace))
+	}
+	if !sa.namespaceMatchesPatterns(requested) {
+		return "", logical.ErrorResponse(fmt.Sprintf("Namespace '%s' is not allowed for ServiceAccount '%s'", requested, sa.Name))
+	}
+	return requested, nil
+}
+
+// checkNamespaceSelector verifies that namespace exists in every target cluster and its labels match selector of
+// the binding
+func (b *kubeBackend) checkNamespaceSelector(ctx context.Context, targets []fanOutTarget, namespace, selector string) (*logical.Response, error) {
+	if selector == "" || b.testMode {
+		return nil, nil
+	}
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("namespace-selector is invalid: %s", err)), nil
+	}
+
+	for _, t := range targets {
+		clientSet, err := b.clientSet(t.sa.Cluster, t.conn)
+		if err != nil {
+			return nil, err
+		}
+		ns, err := clientSet.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return logical.ErrorResponse(fmt.Sprintf("Namespace '%s' not found", namespace)), nil
+		}
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Unable to get namespace '%s', {{err}}", namespace), err)
+		}
+		if !parsed.Matches(labels.Set(ns.Labels)) {
+			return logical.ErrorResponse(fmt.Sprintf("Namespace '%s' doesn't match namespace-selector '%s'", namespace, selector)), nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,277 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const clustersStoragePrefix = "clusters"
+
+func clusterStorageKey(name string) string {
+	return fmt.Sprintf("%s/%s", clustersStoragePrefix, name)
+}
+
+// connectionStorageKey returns where connection of cluster is stored, empty cluster means the default connection
+// from config
+func connectionStorageKey(cluster string) string {
+	if cluster == "" {
+		return ConfigStorageKey
+	}
+	return clusterStorageKey(cluster)
+}
+
+// clusterFromStorageKey is the reverse of connectionStorageKey
+func clusterFromStorageKey(key string) string {
+	return strings.TrimPrefix(key, clustersStoragePrefix+"/")
+}
+
+// getConnection returns connection for cluster, the default connection from config for empty cluster. The result is
+// nil if the connection is not configured.
+func getConnection(ctx context.Context, s logical.Storage, cluster string) (*config, error) {
+	return getConfigEntry(ctx, s, connectionStorageKey(cluster))
+}
+
+func pathClustersList(b *kubeBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: fmt.Sprintf("%s/?$", clustersStoragePrefix),
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathClustersList,
+		},
+		HelpSynopsis:    pathClustersHelpSyn,
+		HelpDescription: pathClustersHelpDesc,
+	}
+}
+
+func pathClusters(b *kubeBackend) *framework.Path {
+	fields := connectionFields()
+	fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Required. Name of the cluster connection",
+	}
+	fields["labels"] = &framework.FieldSchema{
+		Type:        framework.TypeKVPairs,
+		Description: "Optional. Labels of the cluster, bindings with cluster-selector issue tokens in all matching clusters",
+	}
+	fields["force"] = &framework.FieldSchema{
+		Type: framework.TypeBool,
+		Description: `Optional, used on delete. Delete the connection although live leases or queued revocations still
+need it, their objects are then left in the cluster`,
+	}
+
+	return &framework.Path{
+		Pattern: fmt.Sprintf("%s/%s", clustersStoragePrefix, framework.GenericNameRegex("name")),
+		Fields:  fields,
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathClustersRead,
+			logical.UpdateOperation: b.pathClustersWrite,
+			logical.DeleteOperation: b.pathClustersDelete,
+		},
+		HelpSynopsis:    pathClustersHelpSyn,
+		HelpDescription: pathClustersHelpDesc,
+	}
+}
+
+func pathClustersRotateRoot(b *kubeBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: fmt.Sprintf("%s/%s/rotate-root", clustersStoragePrefix, framework.GenericNameRegex("name")),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Required. Name of the cluster connection",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                    b.pathClustersRotateRootUpdate,
+				ForwardPerformanceStandby:   true,
+				ForwardPerformanceSecondary: true,
+			},
+		},
+		HelpSynopsis:    pathConfigRotateRootHelpSyn,
+		HelpDescription: pathConfigRotateRootHelpDesc,
+	}
+}
+
+func (b *kubeBackend) pathClustersList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	list, err := req.Storage.List(ctx, fmt.Sprintf("%s/", clustersStoragePrefix))
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(list), nil
+}
+
+func (b *kubeBackend) pathClustersRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	cfg, err := getConfigEntry(ctx, req.Storage, clusterStorageKey(d.Get("name").(string)))
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return nil, nil
+	}
+	respData := cfg.connectionResponseData()
+	respData["labels"] = cfg.Labels
+
+	return &logical.Response{
+		Data: respData,
+	}, nil
+}
+
+func (b *kubeBackend) pathClustersWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.configMutex.Lock()
+	defer b.configMutex.Unlock()
+	name := d.Get("name").(string)
+	cfg, err := getConfigEntry(ctx, req.Storage, clusterStorageKey(name))
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg == nil {
+		if _, ok := d.GetOk("api-url"); !ok {
+			return logical.ErrorResponse("api-url is required"), nil
+		}
+		if _, ok := d.GetOk("token"); !ok {
+			return logical.ErrorResponse("token is required"), nil
+		}
+		cfg = &config{}
+	}
+
+	if errResp := cfg.updateConnection(d); errResp != nil {
+		return errResp, nil
+	}
+
+	labelsRaw, ok := d.GetOk("labels")
+	if ok {
+		cfg.Labels = labelsRaw.(map[string]string)
+	}
+
+	if d.Get("verify-connection").(bool) && !b.testMode {
+		errResp, err := b.verifyClusterConnection(ctx, req.Storage, name, cfg)
+		if err != nil || errResp != nil {
+			return errResp, err
+		}
+	}
+
+	if err := putConfigEntry(ctx, req.Storage, clusterStorageKey(name), cfg); err != nil {
+		return nil, err
+	}
+	b.invalidateClient(clusterStorageKey(name))
+	return nil, nil
+}
+
+func (b *kubeBackend) pathClustersDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.configMutex.Lock()
+	defer b.configMutex.Unlock()
+	name := d.Get("name").(string)
+
+	bindings, err := listServiceAccounts(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	var used []string
+	for _, sa := range bindings {
+		if sa.Cluster == name || strutil.StrListContains(sa.Clusters, name) {
+			used = append(used, sa.Name)
+		}
+	}
+	if len(used) > 0 {
+		return logical.ErrorResponse(fmt.Sprintf("Cluster '%s' is used by ServiceAccounts: %s", name, strings.Join(used, ", "))), nil
+	}
+
+	leases, revocations, err := clusterRevocations(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	var warnings []string
+	if leases > 0 || revocations > 0 {
+		problem := fmt.Sprintf("Cluster '%s' is needed to revoke %d live leases and %d pending revocations", name, leases, revocations)
+		if !d.Get("force").(bool) {
+			return logical.ErrorResponse(problem + ", revoke them first or delete with force=true"), nil
+		}
+		warnings = append(warnings, problem+", their objects are left in the cluster")
+	}
+
+	if err := req.Storage.Delete(ctx, clusterStorageKey(name)); err != nil {
+		return nil, err
+	}
+	b.invalidateClient(clusterStorageKey(name))
+	if len(warnings) > 0 {
+		return &logical.Response{Warnings: warnings}, nil
+	}
+	return nil, nil
+}
+
+// clusterRevocations counts live leases and queued revocations which delete objects in cluster
+func clusterRevocations(ctx context.Context, s logical.Storage, cluster string) (int, int, error) {
+	records, err := listLeaseRecords(ctx, s)
+	if err != nil {
+		return 0, 0, err
+	}
+	leases := 0
+	for _, record := range records {
+		if record.usesCluster(cluster) {
+			leases++
+		}
+	}
+	pending, err := listPendingRevocations(ctx, s)
+	if err != nil {
+		return 0, 0, err
+	}
+	revocations := 0
+	for _, r := range pending {
+		if c, _ := r.InternalData["cluster"].(string); c == cluster {
+			revocations++
+		}
+	}
+	return leases, revocations, nil
+}
+
+func (b *kubeBackend) pathClustersRotateRootUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.configMutex.Lock()
+	defer b.configMutex.Unlock()
+	name := d.Get("name").(string)
+	cfg, err := getConfigEntry(ctx, req.Storage, clusterStorageKey(name))
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return logical.ErrorResponse(fmt.Sprintf("Cluster '%s' not found", name)), nil
+	}
+
+	warnings, err := b.rotateRootToken(ctx, req.Storage, clusterStorageKey(name), cfg)
+	if err == logical.ErrReadOnly {
+		// Vault forwards the request to the active node then
+		return nil, err
+	}
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if len(warnings) == 0 {
+		return nil, nil
+	}
+	return &logical.Response{Warnings: warnings}, nil
+}
+
+// bindingsForCluster filters bindings which issue tokens in cluster with labels, empty cluster means the default
+// connection
+func bindingsForCluster(bindings []*ServiceAccount, cluster string, labels map[string]string) []*ServiceAccount {
+	var result []*ServiceAccount
+	for _, sa := range bindings {
+		if sa.usesCluster(cluster, labels) {
+			result = append(result, sa)
+		}
+	}
+	return result
+}
+
+const pathClustersHelpSyn = `Configure named Kubernetes cluster connections`
+
+const pathClustersHelpDesc = `
+A single mount can issue tokens in several Kubernetes clusters. Every cluster connection has the same credentials as
+ config, ServiceAccount bindings refer to a connection with the cluster field. TTLs and kubeconfig templates are
+ shared by all connections and configured in config.`
@@ -0,0 +1,321 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestClusters(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	request := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/us-east1", clustersStoragePrefix),
+		Data: map[string]interface{}{
+			"token": "123qwe",
+		},
+		Storage: s,
+	}
+
+	e := "api-url is required"
+	resp, _ := b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.Data["api-url"] = "https://us-east1:6443"
+	request.Data["CA"] = "aGVsbG8K"
+	assertNoErrorRequest(t, b, request)
+
+	resp = assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("%s/us-east1", clustersStoragePrefix),
+		Storage:   s,
+	})
+	assertEquals(t, resp.Data["api-url"], "https://us-east1:6443", "")
+	if _, ok := resp.Data["token"]; ok {
+		t.Errorf("Token should never be returned")
+	}
+
+	resp = assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      fmt.Sprintf("%s/", clustersStoragePrefix),
+		Storage:   s,
+	})
+	assertEquals(t, len(resp.Data["keys"].([]string)), 1, "")
+
+	request = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":            "test",
+			"service-account-name": "test",
+			"cluster":              "unknown",
+		},
+		Storage: s,
+	}
+
+	e = "Cluster 'unknown' not found"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.Data["cluster"] = "us-east1"
+	assertNoErrorRequest(t, b, request)
+
+	// Binding uses named cluster, so the default connection from config is not needed
+	resp = assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", secretsStoragePrefix),
+		Data: map[string]interface{}{
+			"output-format": outputFormatKubeconfig,
+		},
+		Storage: s,
+	})
+	assertEquals(t, resp.Secret.InternalData["cluster"], "us-east1", "")
+	kubeconfig, err := clientcmd.Load([]byte(resp.Data["kubeconfig"].(string)))
+	assertNoError(t, err)
+	assertEquals(t, kubeconfig.Clusters["us-east1:6443"].Server, "https://us-east1:6443", "")
+	leases, _, err := clusterRevocations(context.Background(), s, "us-east1")
+	assertNoError(t, err)
+	assertEquals(t, leases, 1, "Live lease must need its cluster")
+
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	assertNoError(t, err)
+
+	e = "Cluster 'us-east1' is used by ServiceAccounts: test"
+	resp, _ = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      fmt.Sprintf("%s/us-east1", clustersStoragePrefix),
+		Storage:   s,
+	})
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      fmt.Sprintf("%s/test", saStoragePrefix),
+		Storage:   s,
+	})
+
+	// Revocation queued for the cluster still needs its connection
+	assertNoError(t, putPendingRevocation(context.Background(), s, &pendingRevocation{
+		ID:           "abc",
+		InternalData: map[string]interface{}{"cluster": "us-east1", "secret-name": "vault-test-abc", "namespace": "test"},
+	}))
+	request = &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      fmt.Sprintf("%s/us-east1", clustersStoragePrefix),
+		Data:      map[string]interface{}{},
+		Storage:   s,
+	}
+	e = "Cluster 'us-east1' is needed to revoke 0 live leases and 1 pending revocations, revoke them first or delete with force=true"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.Data["force"] = true
+	resp = assertNoErrorRequest(t, b, request)
+	if resp == nil || len(resp.Warnings) != 1 {
+		t.Errorf("Forced deletion must warn about objects left in the cluster, get %#v", resp)
+	}
+}
+
+func TestClustersFanOut(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	for name, env := range map[string]string{"us-east1": "prod", "eu-west1": "prod", "staging": "staging"} {
+		assertNoErrorRequest(t, b, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      fmt.Sprintf("%s/%s", clustersStoragePrefix, name),
+			Data: map[string]interface{}{
+				"api-url": fmt.Sprintf("https://%s:6443", name),
+				"token":   "123qwe",
+				"CA":      "aGVsbG8K",
+				"labels":  fmt.Sprintf("env=%s", env),
+			},
+			Storage: s,
+		})
+	}
+
+	request := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/deploy-bot", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":            "test",
+			"service-account-name": "deploy-bot",
+			"cluster":              "staging",
+			"cluster-selector":     "env=prod",
+		},
+		Storage: s,
+	}
+
+	e := "only one of cluster, clusters and cluster-selector can be set"
+	resp, _ := b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	delete(request.Data, "cluster")
+	request.Data["cluster-selector"] = "env in ("
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp == nil || !resp.IsError() || !strings.HasPrefix(resp.Error().Error(), "cluster-selector is invalid") {
+		t.Errorf("Invalid cluster-selector must be rejected, get '%v'", resp)
+	}
+
+	request.Data["cluster-selector"] = "env=prod"
+	assertNoErrorRequest(t, b, request)
+
+	resp = assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/deploy-bot", secretsStoragePrefix),
+		Data: map[string]interface{}{
+			"output-format": outputFormatKubeconfig,
+		},
+		Storage: s,
+	})
+	clusters := resp.Data["clusters"].(map[string]interface{})
+	assertEquals(t, len(clusters), 2, "Tokens must be issued in all matching clusters")
+	assertEquals(t, clusters["us-east1"].(map[string]interface{})["token"], "test", "")
+	assertEquals(t, len(fanOutTokens(resp.Secret.InternalData)), 2, "")
+
+	kubeconfig, err := clientcmd.Load([]byte(resp.Data["kubeconfig"].(string)))
+	assertNoError(t, err)
+	assertEquals(t, len(kubeconfig.Contexts), 2, "")
+	assertEquals(t, kubeconfig.CurrentContext, "deploy-bot@eu-west1:6443", "")
+
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	assertNoError(t, err)
+
+	wals, err := s.List(context.Background(), "wal/")
+	assertNoError(t, err)
+	assertEquals(t, len(wals), 0, "WAL entries must be committed once the lease is returned")
+
+	records, err := listLeaseRecords(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, len(records), 0, "Lease record must be removed on revoke")
+
+	request.Data["cluster-selector"] = "env=dev"
+	assertNoErrorRequest(t, b, request)
+
+	e = "No cluster matches cluster-selector 'env=dev'"
+	resp, _ = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/deploy-bot", secretsStoragePrefix),
+		Storage:   s,
+	})
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.Data["cluster-selector"] = ""
+	request.Data["clusters"] = "us-east1,staging"
+	assertNoErrorRequest(t, b, request)
+
+	e = "Cluster 'staging' is used by ServiceAccounts: deploy-bot"
+	resp, _ = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      fmt.Sprintf("%s/staging", clustersStoragePrefix),
+		Storage:   s,
+	})
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+}
+
+// cancelOnGetStorage cancels the request context once key is read, which happens when revocation starts
+type cancelOnGetStorage struct {
+	logical.Storage
+	key    string
+	cancel context.CancelFunc
+}
+
+func (s *cancelOnGetStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	if key == s.key && s.cancel != nil {
+		s.cancel()
+	}
+	return s.Storage.Get(ctx, key)
+}
+
+func TestIssueTokensPartialFailure(t *testing.T) {
+	b, storage := getTestBackend(t)
+	kb := b.(*kubeBackend)
+	kb.testMode = false
+
+	var mutex sync.Mutex
+	var deleted []string
+	good := newTestKubeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodDelete {
+			mutex.Lock()
+			deleted = append(deleted, r.URL.Path)
+			mutex.Unlock()
+			_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Success"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"kind":"RoleBinding","apiVersion":"rbac.authorization.k8s.io/v1","metadata":{"name":"binding"}}`))
+	}))
+	bad := newTestKubeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","message":"boom","code":500}`))
+	}))
+	assertNoError(t, putConfigEntry(context.Background(), storage, clusterStorageKey("good"), good))
+	assertNoError(t, putConfigEntry(context.Background(), storage, clusterStorageKey("bad"), bad))
+
+	s := &cancelOnGetStorage{Storage: storage, key: clusterStorageKey("good")}
+	targets, errResp, err := fanOutTargets(context.Background(), s, &ServiceAccount{
+		Name:        "deploy-bot",
+		Namespace:   "test",
+		BindingType: bindingTypeGrant,
+		ClusterRole: "edit",
+		SubjectKind: subjectKindUser,
+		SubjectName: "alice",
+		Clusters:    []string{"good", "bad"},
+	})
+	assertNoError(t, err)
+	if errResp != nil {
+		t.Fatalf("Targets must be resolved, get '%s'", errResp.Error())
+	}
+
+	// Request context is cancelled before the token issued in cluster 'good' is revoked
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.cancel = cancel
+	tokens, err := kb.issueTokens(ctx, s, targets, 0, nil, nil, &provenance{})
+	if tokens != nil || err == nil || !strings.Contains(err.Error(), "cluster 'bad'") {
+		t.Fatalf("Issuance must fail in cluster 'bad', get tokens %v and error '%v'", tokens, err)
+	}
+	if strings.Contains(err.Error(), "cluster 'good'") {
+		t.Errorf("Only cluster 'bad' must be reported, get '%s'", err)
+	}
+
+	mutex.Lock()
+	assertEquals(t, len(deleted), 1, "Token issued in cluster 'good' must be revoked")
+	mutex.Unlock()
+
+	// Only the WAL entry of the failed token is left for rollback
+	walIDs, err := framework.ListWAL(context.Background(), storage)
+	assertNoError(t, err)
+	assertEquals(t, len(walIDs), 1, "")
+}
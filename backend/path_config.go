@@ -2,6 +2,7 @@ package backend
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
@@ -11,31 +12,75 @@ import (
 const ConfigStorageKey = "config"
 const ConfigPath = "config"
 
+// defaultTokenWaitTimeout bounds waiting for Kubernetes to populate a token Secret or sign a certificate
+const defaultTokenWaitTimeout = 10 * time.Second
+
+// connectionFields describe how to reach Kubernetes cluster, they are shared by config and clusters/<name>
+func connectionFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"token": {
+			Type:        framework.TypeString,
+			Description: `ServiceAccount token with permissions to list, create, delete Secrets`,
+		},
+		"api-url": {
+			Type:        framework.TypeString,
+			Description: `URL to kubernetes apiserver https endpoint`,
+		},
+		"CA": {
+			Type:        framework.TypeString,
+			Description: `Kubernetes apiserver Certificate Authority (base64 encoded)`,
+		},
+		"rotation-period": {
+			Type: framework.TypeDurationSecond,
+			Description: `Rotate the token automatically when it gets older than this period. 0 (default) disables
+automatic rotation`,
+		},
+		"rotation-window": {
+			Type: framework.TypeDurationSecond,
+			Description: `Optional. Automatic rotation starts this long before rotation-period ends, so failed
+attempts are retried before the token reaches rotation-period age`,
+		},
+		"verify-connection": {
+			Type: framework.TypeBool,
+			Description: `Check that API server is reachable and the token has all permissions needed by
+configured bindings before config is stored. Set to false for bootstrapping`,
+			Default: true,
+		},
+	}
+}
+
 func pathConfig(b *kubeBackend) *framework.Path {
+	fields := connectionFields()
+	fields["ttl"] = &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "Default lease for generated secrets. If <= 0, will use system default.",
+	}
+	fields["max-ttl"] = &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "Maximum time a secret is valid for. If <= 0, will use system default.",
+	}
+	fields["token-wait-timeout"] = &framework.FieldSchema{
+		Type: framework.TypeDurationSecond,
+		Description: `How long to wait for Kubernetes to populate a token Secret or sign a certificate before the
+request fails. Default is 10s`,
+	}
+	fields["kubeconfig-cluster-name-template"] = &framework.FieldSchema{
+		Type: framework.TypeString,
+		Description: `Template of the cluster name in generated kubeconfig. Available fields: {{.Name}}, {{.Namespace}},
+{{.ServiceAccountName}}, {{.Cluster}}, {{.Host}}. Default is '` + defaultKubeconfigClusterTemplate + `'`,
+	}
+	fields["kubeconfig-user-name-template"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: `Template of the user name in generated kubeconfig. Default is '` + defaultKubeconfigUserTemplate + `'`,
+	}
+	fields["kubeconfig-context-name-template"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: `Template of the context name in generated kubeconfig. Default is '` + defaultKubeconfigContextTemplate + `'`,
+	}
+
 	return &framework.Path{
 		Pattern: ConfigPath,
-		Fields: map[string]*framework.FieldSchema{
-			"token": {
-				Type:        framework.TypeString,
-				Description: `ServiceAccount token with permissions to list, create, delete Secrets`,
-			},
-			"api-url": {
-				Type:        framework.TypeString,
-				Description: `URL to kubernetes apiserver https endpoint`,
-			},
-			"CA": {
-				Type:        framework.TypeString,
-				Description: `Kubernetes apiserver Certificate Authority (base64 encoded)`,
-			},
-			"ttl": {
-				Type:        framework.TypeDurationSecond,
-				Description: "Default lease for generated secrets. If <= 0, will use system default.",
-			},
-			"max-ttl": {
-				Type:        framework.TypeDurationSecond,
-				Description: "Maximum time a secret is valid for. If <= 0, will use system default.",
-			},
-		},
+		Fields:  fields,
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ReadOperation:   b.pathConfigRead,
@@ -58,42 +103,33 @@ func (b *kubeBackend) pathConfigRead(ctx context.Context, req *logical.Request,
 		return nil, nil
 	}
 
+	respData := cfg.connectionResponseData()
+	respData["ttl"] = int64(cfg.TTL / time.Second)
+	respData["max-ttl"] = int64(cfg.MaxTTL / time.Second)
+	respData["token-wait-timeout"] = int64(cfg.tokenWaitTimeout() / time.Second)
+	respData["kubeconfig-cluster-name-template"] = cfg.kubeconfigClusterTemplate()
+	respData["kubeconfig-user-name-template"] = cfg.kubeconfigUserTemplate()
+	respData["kubeconfig-context-name-template"] = cfg.kubeconfigContextTemplate()
+
 	return &logical.Response{
-		Data: map[string]interface{}{
-			"api-url": cfg.APIURL,
-			"ttl":     int64(cfg.TTL / time.Second),
-			"max-ttl": int64(cfg.MaxTTL / time.Second),
-			"CA":      cfg.CA,
-		},
+		Data: respData,
 	}, nil
 }
 
 func (b *kubeBackend) pathConfigWrite(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.configMutex.Lock()
+	defer b.configMutex.Unlock()
 	cfg, err := getConfig(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
 
 	if cfg == nil {
-		cfg = &config{
-			TTL:    1800 * time.Second,
-			MaxTTL: 3600 * time.Second,
-		}
+		cfg = defaultConfig()
 	}
 
-	tokenRaw, ok := data.GetOk("token")
-	if ok {
-		cfg.Token = tokenRaw.(string)
-	}
-
-	apiURL, ok := data.GetOk("api-url")
-	if ok {
-		cfg.APIURL = apiURL.(string)
-	}
-
-	CARaw, ok := data.GetOk("CA")
-	if ok {
-		cfg.CA = CARaw.(string)
+	if errResp := cfg.updateConnection(data); errResp != nil {
+		return errResp, nil
 	}
 
 	// Update token TTL.
@@ -108,22 +144,51 @@ func (b *kubeBackend) pathConfigWrite(ctx context.Context, req *logical.Request,
 		cfg.MaxTTL = time.Duration(maxTTLRaw.(int)) * time.Second
 	}
 
-	entry, err := logical.StorageEntryJSON(ConfigStorageKey, cfg)
-	if err != nil {
-		return nil, err
+	tokenWaitTimeoutRaw, ok := data.GetOk("token-wait-timeout")
+	if ok {
+		cfg.TokenWaitTimeout = time.Duration(tokenWaitTimeoutRaw.(int)) * time.Second
+		if cfg.TokenWaitTimeout < 0 {
+			return logical.ErrorResponse("token-wait-timeout can't be negative"), nil
+		}
+	}
+
+	for field, tpl := range map[string]*string{
+		"kubeconfig-cluster-name-template": &cfg.KubeconfigClusterTemplate,
+		"kubeconfig-user-name-template":    &cfg.KubeconfigUserTemplate,
+		"kubeconfig-context-name-template": &cfg.KubeconfigContextTemplate,
+	} {
+		tplRaw, ok := data.GetOk(field)
+		if !ok {
+			continue
+		}
+		if err := validateKubeconfigTemplate(tplRaw.(string)); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("%s is invalid: %s", field, err)), nil
+		}
+		*tpl = tplRaw.(string)
+	}
+
+	if data.Get("verify-connection").(bool) && !b.testMode {
+		errResp, err := b.verifyClusterConnection(ctx, req.Storage, "", cfg)
+		if err != nil || errResp != nil {
+			return errResp, err
+		}
 	}
 
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	if err := putConfigEntry(ctx, req.Storage, ConfigStorageKey, cfg); err != nil {
 		return nil, err
 	}
+	b.invalidateClient(ConfigStorageKey)
 
 	return nil, nil
 }
 
 func (b *kubeBackend) pathConfigDelete(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.configMutex.Lock()
+	defer b.configMutex.Unlock()
 	if err := req.Storage.Delete(ctx, ConfigStorageKey); err != nil {
 		return nil, err
 	}
+	b.invalidateClient(ConfigStorageKey)
 
 	return nil, nil
 }
@@ -135,11 +200,154 @@ type config struct {
 
 	TTL    time.Duration
 	MaxTTL time.Duration
+
+	KubeconfigClusterTemplate string
+	KubeconfigUserTemplate    string
+	KubeconfigContextTemplate string
+
+	TokenWaitTimeout time.Duration
+
+	// Labels of a named cluster, bindings select clusters by them
+	Labels map[string]string
+
+	RotationPeriod time.Duration
+	RotationWindow time.Duration
+	// LastRotated is the time the token was written or rotated last time
+	LastRotated time.Time
+	// RotationFailures counts automatic rotation attempts failed in a row, LastRotationError is the last failure and
+	// LastRotationAttempt is when it happened
+	RotationFailures    int
+	LastRotationError   string
+	LastRotationAttempt time.Time
+}
+
+func defaultConfig() *config {
+	return &config{
+		TTL:    1800 * time.Second,
+		MaxTTL: 3600 * time.Second,
+	}
+}
+
+func (c *config) tokenWaitTimeout() time.Duration {
+	if c.TokenWaitTimeout <= 0 {
+		return defaultTokenWaitTimeout
+	}
+	return c.TokenWaitTimeout
+}
+
+// getTokenWaitTimeout returns token-wait-timeout from config, it applies to all clusters
+func getTokenWaitTimeout(ctx context.Context, s logical.Storage) (time.Duration, error) {
+	cfg, err := getConfig(ctx, s)
+	if err != nil {
+		return 0, err
+	}
+	if cfg == nil {
+		cfg = defaultConfig()
+	}
+	return cfg.tokenWaitTimeout(), nil
+}
+
+// updateConnection applies connectionFields from data to c
+func (c *config) updateConnection(data *framework.FieldData) *logical.Response {
+	tokenRaw, ok := data.GetOk("token")
+	if ok {
+		c.Token = tokenRaw.(string)
+		c.LastRotated = time.Now()
+		c.RotationFailures = 0
+		c.LastRotationError = ""
+	}
+
+	apiURL, ok := data.GetOk("api-url")
+	if ok {
+		c.APIURL = apiURL.(string)
+	}
+
+	CARaw, ok := data.GetOk("CA")
+	if ok {
+		c.CA = CARaw.(string)
+	}
+
+	rotationPeriodRaw, ok := data.GetOk("rotation-period")
+	if ok {
+		c.RotationPeriod = time.Duration(rotationPeriodRaw.(int)) * time.Second
+	}
+
+	rotationWindowRaw, ok := data.GetOk("rotation-window")
+	if ok {
+		c.RotationWindow = time.Duration(rotationWindowRaw.(int)) * time.Second
+	}
+
+	if c.RotationPeriod < 0 || c.RotationWindow < 0 {
+		return logical.ErrorResponse("rotation-period and rotation-window can't be negative")
+	}
+	if c.RotationWindow > 0 && c.RotationWindow >= c.RotationPeriod {
+		return logical.ErrorResponse("rotation-window must be shorter than rotation-period")
+	}
+	return nil
+}
+
+// connectionResponseData returns connectionFields of c, token is never returned
+func (c *config) connectionResponseData() map[string]interface{} {
+	return map[string]interface{}{
+		"api-url": c.APIURL,
+		"CA":      c.CA,
+
+		"rotation-period":     int64(c.RotationPeriod / time.Second),
+		"rotation-window":     int64(c.RotationWindow / time.Second),
+		"last-rotated":        formatTime(c.LastRotated),
+		"rotation-failures":   c.RotationFailures,
+		"last-rotation-error": c.LastRotationError,
+	}
+}
+
+// rotationDue reports whether automatic rotation of the token should be attempted at now
+func (c *config) rotationDue(now time.Time) bool {
+	if c.RotationPeriod <= 0 {
+		return false
+	}
+	// Failed attempts create and delete a Secret each, they are retried with the backoff of failed revocations
+	if c.RotationFailures > 0 && now.Before(c.LastRotationAttempt.Add(revocationBackoff(c.RotationFailures))) {
+		return false
+	}
+	return !now.Before(c.LastRotated.Add(c.RotationPeriod - c.RotationWindow))
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (c *config) kubeconfigClusterTemplate() string {
+	if c.KubeconfigClusterTemplate == "" {
+		return defaultKubeconfigClusterTemplate
+	}
+	return c.KubeconfigClusterTemplate
+}
+
+func (c *config) kubeconfigUserTemplate() string {
+	if c.KubeconfigUserTemplate == "" {
+		return defaultKubeconfigUserTemplate
+	}
+	return c.KubeconfigUserTemplate
+}
+
+func (c *config) kubeconfigContextTemplate() string {
+	if c.KubeconfigContextTemplate == "" {
+		return defaultKubeconfigContextTemplate
+	}
+	return c.KubeconfigContextTemplate
 }
 
 func getConfig(ctx context.Context, s logical.Storage) (*config, error) {
+	return getConfigEntry(ctx, s, ConfigStorageKey)
+}
+
+// getConfigEntry reads connection stored under key, either ConfigStorageKey or clusterStorageKey
+func getConfigEntry(ctx context.Context, s logical.Storage, key string) (*config, error) {
 	var cfg config
-	cfgRaw, err := s.Get(ctx, ConfigStorageKey)
+	cfgRaw, err := s.Get(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -154,8 +362,17 @@ func getConfig(ctx context.Context, s logical.Storage) (*config, error) {
 	return &cfg, err
 }
 
+func putConfigEntry(ctx context.Context, s logical.Storage, key string, cfg *config) error {
+	entry, err := logical.StorageEntryJSON(key, cfg)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
 const pathConfigHelpSyn = `Configure the Kubernetes backend`
 
 const pathConfigHelpDesc = `
 The Kubernetes backend requires credentials for managing Secrets in cluster. This endpoint is used to configure those
- credentials as well as default values for the backend in general.`
+ credentials as well as default values for the backend in general. Before storing config the plugin checks that the API
+ server is reachable and the token has all needed permissions, unless verify-connection is false.`
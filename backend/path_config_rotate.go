@@ -0,0 +1,297 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const ConfigRotateRootPath = "config/rotate-root"
+
+func pathConfigRotateRoot(b *kubeBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: ConfigRotateRootPath,
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathConfigRotateRootUpdate,
+				// Rotation creates a Secret in the cluster and stores its token, standbys can't store it
+				ForwardPerformanceStandby:   true,
+				ForwardPerformanceSecondary: true,
+			},
+		},
+
+		HelpSynopsis:    pathConfigRotateRootHelpSyn,
+		HelpDescription: pathConfigRotateRootHelpDesc,
+	}
+}
+
+func (b *kubeBackend) pathConfigRotateRootUpdate(ctx context.Context, req *logical.Request, data *framework.FieldData) (*logical.Response, error) {
+	b.configMutex.Lock()
+	defer b.configMutex.Unlock()
+	cfg, err := getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg == nil {
+		return logical.ErrorResponse("Please configure plugin with 'config' path"), nil
+	}
+
+	warnings, err := b.rotateRootToken(ctx, req.Storage, ConfigStorageKey, cfg)
+	if err == logical.ErrReadOnly {
+		// Vault forwards the request to the active node then
+		return nil, err
+	}
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if len(warnings) == 0 {
+		return nil, nil
+	}
+	return &logical.Response{Warnings: warnings}, nil
+}
+
+// rotateRootTokensIfDue rotates tokens of config and all clusters which are due for rotation
+func (b *kubeBackend) rotateRootTokensIfDue(ctx context.Context, s logical.Storage) error {
+	keys := []string{ConfigStorageKey}
+	clusters, err := s.List(ctx, fmt.Sprintf("%s/", clustersStoragePrefix))
+	if err != nil {
+		return err
+	}
+	for _, cluster := range clusters {
+		keys = append(keys, clusterStorageKey(cluster))
+	}
+
+	var result error
+	for _, key := range keys {
+		if err := b.rotateRootTokenIfDue(ctx, s, key); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result
+}
+
+// rotateRootTokenIfDue rotates the token stored under key once it gets older than rotation period minus rotation
+// window. A failed attempt is recorded in the connection and retried on the next call.
+func (b *kubeBackend) rotateRootTokenIfDue(ctx context.Context, s logical.Storage, key string) error {
+	b.configMutex.Lock()
+	defer b.configMutex.Unlock()
+	cfg, err := getConfigEntry(ctx, s, key)
+	if err != nil {
+		return err
+	}
+	if cfg == nil || !cfg.rotationDue(time.Now()) {
+		return nil
+	}
+
+	warnings, err := b.rotateRootToken(ctx, s, key, cfg)
+	if err != nil {
+		b.Logger().Error("automatic rotation of root token failed", "connection", key, "error", err)
+		cfg.RotationFailures++
+		cfg.LastRotationError = err.Error()
+		cfg.LastRotationAttempt = time.Now()
+		return putConfigEntry(ctx, s, key, cfg)
+	}
+	for _, warning := range warnings {
+		b.Logger().Warn(warning, "connection", key)
+	}
+	return nil
+}
+
+// rotateRootToken replaces token in cfg with a new one for the same ServiceAccount and stores cfg under key. The
+// Secret behind the old token is deleted afterwards, a failure to delete it is returned as a warning, because the new
+// token is already persisted at that moment. Caller must hold configMutex.
+func (b *kubeBackend) rotateRootToken(ctx context.Context, s logical.Storage, key string, cfg *config) ([]string, error) {
+	claims, err := parseServiceAccountToken(cfg.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	newCfg := *cfg
+	newCfg.LastRotated = time.Now()
+	newCfg.RotationFailures = 0
+	newCfg.LastRotationError = ""
+	newCfg.LastRotationAttempt = time.Time{}
+	var warnings []string
+
+	if !b.testMode {
+		clientSet, err := getClientSet(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		timeout, err := getTokenWaitTimeout(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		name := fmt.Sprintf("%s-%s-%s", secretPrefix, claims.ServiceAccountName, generatePostfix(8))
+		// The Secret holds a token as powerful as the stored one, rollback deletes it unless it's stored in config
+		walID, err := framework.PutWAL(ctx, s, secretWALKind, &walSecret{
+			Name:      name,
+			Namespace: claims.Namespace,
+			Cluster:   clusterFromStorageKey(key),
+			APIURL:    cfg.APIURL,
+		})
+		if err != nil {
+			return nil, err
+		}
+		deleteSecret := func(ctx context.Context) error {
+			return clientSet.CoreV1().Secrets(claims.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		}
+		_, err = clientSet.CoreV1().Secrets(claims.Namespace).Create(ctx, &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Annotations: map[string]string{
+					"kubernetes.io/service-account.name": claims.ServiceAccountName,
+				},
+			},
+			Type: "kubernetes.io/service-account-token",
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return nil, errwrap.Wrapf("Unable to create secret for new token, {{err}}", err)
+		}
+
+		secret, err := waitForSecretToken(ctx, clientSet, claims.Namespace, name, timeout)
+		if err == nil {
+			newCfg.Token = string(secret.Data["token"])
+			err = verifyRootToken(ctx, &newCfg, claims.Namespace)
+		}
+		if err != nil {
+			b.rollbackNow(s, walID, deleteSecret)
+			return nil, err
+		}
+		if err := putConfigEntry(ctx, s, key, &newCfg); err != nil {
+			b.rollbackNow(s, walID, deleteSecret)
+			return nil, err
+		}
+		// walRollback leaves the Secret of a stored token alone, a WAL entry left behind is harmless
+		if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+			b.Logger().Warn("unable to remove WAL entry of rotated root token", "connection", key, "error", err)
+		}
+	} else {
+		newCfg.Token = "test"
+		if err := putConfigEntry(ctx, s, key, &newCfg); err != nil {
+			return nil, err
+		}
+	}
+	b.invalidateClient(key)
+
+	if claims.SecretName == "" {
+		warnings = append(warnings, "Old token was issued through the TokenRequest API, it stays valid until it expires. "+
+			"The new token is backed by a ServiceAccount token Secret and doesn't expire")
+	}
+	// Token issued through the TokenRequest API has no Secret to delete, it expires on its own
+	if claims.SecretName != "" && !b.testMode {
+		clientSet, err := getClientSet(&newCfg)
+		if err == nil {
+			err = clientSet.CoreV1().Secrets(claims.Namespace).Delete(ctx, claims.SecretName, metav1.DeleteOptions{})
+		}
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("New token is stored, but old Secret '%s/%s' wasn't deleted: %s",
+				claims.Namespace, claims.SecretName, err))
+		}
+	}
+
+	return warnings, nil
+}
+
+// isRootTokenSecret reports whether the token of connection of cluster is backed by Secret namespace/name
+func isRootTokenSecret(ctx context.Context, s logical.Storage, cluster, namespace, name string) (bool, error) {
+	c, err := getConnection(ctx, s, cluster)
+	if err != nil || c == nil {
+		return false, err
+	}
+	claims, err := parseServiceAccountToken(c.Token)
+	if err != nil {
+		return false, nil
+	}
+	return claims.Namespace == namespace && claims.SecretName == name, nil
+}
+
+// verifyRootToken checks that cfg authenticates against the API server and is still allowed to manage Secrets
+func verifyRootToken(ctx context.Context, cfg *config, namespace string) error {
+	clientSet, err := getClientSet(cfg)
+	if err != nil {
+		return err
+	}
+	denied, err := checkPermissions(ctx, clientSet, namespace, secretPermissions)
+	if err != nil {
+		return errwrap.Wrapf("New token was rejected by API server, {{err}}", err)
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("New token is %s", strings.Join(denied, ", "))
+	}
+	return nil
+}
+
+// serviceAccountClaims identifies ServiceAccount the token belongs to
+type serviceAccountClaims struct {
+	Namespace          string
+	ServiceAccountName string
+	// SecretName is empty for tokens issued through the TokenRequest API
+	SecretName string
+}
+
+// parseServiceAccountToken reads claims of ServiceAccount JWT without verifying its signature, it supports both
+// legacy Secret-based and TokenRequest-issued tokens
+func parseServiceAccountToken(token string) (*serviceAccountClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a ServiceAccount JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to decode token payload: {{err}}", err)
+	}
+
+	var raw struct {
+		Namespace          string `json:"kubernetes.io/serviceaccount/namespace"`
+		ServiceAccountName string `json:"kubernetes.io/serviceaccount/service-account.name"`
+		SecretName         string `json:"kubernetes.io/serviceaccount/secret.name"`
+		Kubernetes         *struct {
+			Namespace      string `json:"namespace"`
+			ServiceAccount struct {
+				Name string `json:"name"`
+			} `json:"serviceaccount"`
+		} `json:"kubernetes.io"`
+	}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, errwrap.Wrapf("unable to parse token payload: {{err}}", err)
+	}
+
+	claims := &serviceAccountClaims{
+		Namespace:          raw.Namespace,
+		ServiceAccountName: raw.ServiceAccountName,
+		SecretName:         raw.SecretName,
+	}
+	if raw.Kubernetes != nil {
+		claims.Namespace = raw.Kubernetes.Namespace
+		claims.ServiceAccountName = raw.Kubernetes.ServiceAccount.Name
+	}
+	if claims.Namespace == "" || claims.ServiceAccountName == "" {
+		return nil, errors.New("token doesn't belong to a ServiceAccount")
+	}
+	return claims, nil
+}
+
+const pathConfigRotateRootHelpSyn = `Rotate the token the plugin uses to access Kubernetes`
+
+const pathConfigRotateRootHelpDesc = `
+Creates a new token for the ServiceAccount of the configured token, checks that it works against the API server and
+stores it in config. The Secret behind the old token is deleted, so the token used during setup is no longer valid.
+The new token is always backed by a ServiceAccount token Secret and doesn't expire, even if the old one was issued
+through the TokenRequest API. Such old token can't be revoked, it stays valid until it expires.
+Set rotation-period in config to rotate the token automatically, failed attempts are retried with backoff from 1 minute
+up to 1 hour.`
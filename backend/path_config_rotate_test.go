@@ -0,0 +1,271 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testServiceAccountJWT(payload string) string {
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2lnbmF0dXJl"
+}
+
+func TestConfigRotateRoot(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	request := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      ConfigRotateRootPath,
+		Storage:   s,
+	}
+
+	e := "Please configure plugin with 'config' path"
+	resp, _ := b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	testConfigUpdate(t, b, s, map[string]interface{}{
+		"token":   "123qwe",
+		"api-url": "https://localhost:8443/",
+		"CA":      "aGVsbG8K",
+	})
+
+	e = "token is not a ServiceAccount JWT"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	testConfigUpdate(t, b, s, map[string]interface{}{
+		"token": testServiceAccountJWT(`{"kubernetes.io/serviceaccount/namespace":"default",` +
+			`"kubernetes.io/serviceaccount/service-account.name":"vault",` +
+			`"kubernetes.io/serviceaccount/secret.name":"vault-token-c8wgn"}`),
+	})
+	assertNoErrorRequest(t, b, request)
+
+	cfg, err := getConfig(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, cfg.Token, "test", "Token should be replaced with a new one")
+	assertEquals(t, cfg.APIURL, "https://localhost:8443/", "Rotation should keep the rest of config")
+}
+
+func TestParseServiceAccountToken(t *testing.T) {
+	claims, err := parseServiceAccountToken(testServiceAccountJWT(`{"kubernetes.io/serviceaccount/namespace":"default",` +
+		`"kubernetes.io/serviceaccount/service-account.name":"vault",` +
+		`"kubernetes.io/serviceaccount/secret.name":"vault-token-c8wgn"}`))
+	assertNoError(t, err)
+	assertEquals(t, *claims, serviceAccountClaims{
+		Namespace:          "default",
+		ServiceAccountName: "vault",
+		SecretName:         "vault-token-c8wgn",
+	}, "")
+
+	claims, err = parseServiceAccountToken(testServiceAccountJWT(
+		`{"kubernetes.io":{"namespace":"kube-system","serviceaccount":{"name":"vault","uid":"123"}}}`))
+	assertNoError(t, err)
+	assertEquals(t, *claims, serviceAccountClaims{
+		Namespace:          "kube-system",
+		ServiceAccountName: "vault",
+	}, "")
+
+	_, err = parseServiceAccountToken(testServiceAccountJWT(`{"sub":"admin"}`))
+	if err == nil {
+		t.Errorf("Token without ServiceAccount claims should be rejected")
+	}
+}
+
+func TestConfigRotateRootPeriodic(t *testing.T) {
+	b, s := getTestBackend(t)
+	kb := b.(*kubeBackend)
+
+	testConfigUpdate(t, b, s, map[string]interface{}{
+		"token":           "123qwe",
+		"api-url":         "https://localhost:8443/",
+		"CA":              "aGVsbG8K",
+		"rotation-period": "720h",
+		"rotation-window": "24h",
+	})
+
+	// Freshly written token is not due for rotation
+	assertNoError(t, kb.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+	cfg, err := getConfig(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, cfg.Token, "123qwe", "")
+
+	// Token which can't be rotated, failure should be recorded
+	cfg.LastRotated = time.Now().Add(-700 * time.Hour)
+	entry, err := logical.StorageEntryJSON(ConfigStorageKey, cfg)
+	assertNoError(t, err)
+	assertNoError(t, s.Put(context.Background(), entry))
+
+	assertNoError(t, kb.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+	cfg, err = getConfig(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, cfg.Token, "123qwe", "")
+	assertEquals(t, cfg.RotationFailures, 1, "")
+	assertEquals(t, cfg.LastRotationError, "token is not a ServiceAccount JWT", "")
+
+	cfg.Token = testServiceAccountJWT(`{"kubernetes.io":{"namespace":"default","serviceaccount":{"name":"vault"}}}`)
+	entry, err = logical.StorageEntryJSON(ConfigStorageKey, cfg)
+	assertNoError(t, err)
+	assertNoError(t, s.Put(context.Background(), entry))
+
+	// Failed attempt is not retried until backoff passes
+	assertNoError(t, kb.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+	cfg, err = getConfig(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, cfg.Token != "test", true, "Token should not be rotated during backoff")
+	assertEquals(t, cfg.RotationFailures, 1, "")
+
+	cfg.LastRotationAttempt = time.Now().Add(-revocationBackoff(cfg.RotationFailures))
+	entry, err = logical.StorageEntryJSON(ConfigStorageKey, cfg)
+	assertNoError(t, err)
+	assertNoError(t, s.Put(context.Background(), entry))
+
+	assertNoError(t, kb.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+	cfg, err = getConfig(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, cfg.Token, "test", "Token should be rotated within rotation window")
+	assertEquals(t, cfg.RotationFailures, 0, "")
+	assertEquals(t, cfg.LastRotationError, "", "")
+	if time.Since(cfg.LastRotated) > time.Minute {
+		t.Errorf("last rotation time should be updated, get %s", cfg.LastRotated)
+	}
+}
+
+func TestConfigRotateRootPeriodicSecondary(t *testing.T) {
+	b := New()
+	b.testMode = true
+	s := &logical.InmemStorage{}
+	assertNoError(t, b.Setup(context.Background(), &logical.BackendConfig{
+		System:      &logical.StaticSystemView{ReplicationStateVal: consts.ReplicationPerformanceSecondary},
+		StorageView: s,
+	}))
+
+	cfg := &config{
+		Token:          testServiceAccountJWT(`{"kubernetes.io":{"namespace":"default","serviceaccount":{"name":"vault"}}}`),
+		APIURL:         "https://localhost:8443/",
+		CA:             "aGVsbG8K",
+		RotationPeriod: 720 * time.Hour,
+		LastRotated:    time.Now().Add(-800 * time.Hour),
+	}
+	assertNoError(t, putConfigEntry(context.Background(), s, ConfigStorageKey, cfg))
+
+	assertNoError(t, b.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+	stored, err := getConfig(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, stored.Token, cfg.Token, "Token must not be rotated on performance secondary")
+	assertEquals(t, stored.RotationFailures, 0, "")
+}
+
+// readOnlyConfigStorage fails to store connections, like storage of a performance standby
+type readOnlyConfigStorage struct {
+	logical.Storage
+}
+
+func (s *readOnlyConfigStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if entry.Key == ConfigStorageKey {
+		return logical.ErrReadOnly
+	}
+	return s.Storage.Put(ctx, entry)
+}
+
+func TestConfigRotateRootStoreFailure(t *testing.T) {
+	b, s := getTestBackend(t)
+	kb := b.(*kubeBackend)
+	kb.testMode = false
+
+	var mutex sync.Mutex
+	var created, deleted string
+	const prefix = "/api/v1/namespaces/default/secrets"
+	c := newTestKubeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == prefix:
+			var secret v1.Secret
+			json.NewDecoder(r.Body).Decode(&secret)
+			created = secret.Name
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(&secret)
+		case r.Method == http.MethodGet && r.URL.Path == prefix:
+			json.NewEncoder(w).Encode(&v1.SecretList{Items: []v1.Secret{{
+				ObjectMeta: metav1.ObjectMeta{Name: created, Namespace: "default"},
+				Data:       map[string][]byte{"token": []byte("rotated")},
+			}}})
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, prefix+"/"):
+			deleted = strings.TrimPrefix(r.URL.Path, prefix+"/")
+			json.NewEncoder(w).Encode(&metav1.Status{Status: metav1.StatusSuccess})
+		case r.URL.Path == "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews":
+			var review authorizationv1.SelfSubjectAccessReview
+			json.NewDecoder(r.Body).Decode(&review)
+			review.Status.Allowed = true
+			json.NewEncoder(w).Encode(&review)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	c.Token = testServiceAccountJWT(`{"kubernetes.io":{"namespace":"default","serviceaccount":{"name":"vault"}}}`)
+
+	_, err := kb.rotateRootToken(context.Background(), &readOnlyConfigStorage{s}, ConfigStorageKey, c)
+	if err != logical.ErrReadOnly {
+		t.Errorf("Error must be '%s', get '%v'", logical.ErrReadOnly, err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if created == "" || deleted != created {
+		t.Errorf("Secret of the token which couldn't be stored must be deleted, created '%s', deleted '%s'", created, deleted)
+	}
+	wals, err := framework.ListWAL(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, len(wals), 0, "WAL entry of the deleted Secret must be removed")
+}
+
+func TestRotateRootForwarded(t *testing.T) {
+	b := New()
+	for _, p := range []*framework.Path{pathConfigRotateRoot(b), pathClustersRotateRoot(b)} {
+		properties := p.Operations[logical.UpdateOperation].Properties()
+		if !properties.ForwardPerformanceStandby || !properties.ForwardPerformanceSecondary {
+			t.Errorf("%s stores the new token, it must be forwarded to the active node of the primary", p.Pattern)
+		}
+	}
+}
+
+func TestWALRollbackRootTokenSecret(t *testing.T) {
+	b, s := getTestBackend(t)
+	kb := b.(*kubeBackend)
+	kb.testMode = false
+
+	c := &config{
+		APIURL: "https://localhost:8443",
+		CA:     "aGVsbG8K",
+		Token: testServiceAccountJWT(`{"kubernetes.io/serviceaccount/namespace":"default",` +
+			`"kubernetes.io/serviceaccount/service-account.name":"vault","kubernetes.io/serviceaccount/secret.name":"vault-vault-abc"}`),
+	}
+	assertNoError(t, putConfigEntry(context.Background(), s, ConfigStorageKey, c))
+
+	// Rotation stored the token, but didn't remove its WAL entry. Rollback of any other Secret would fail here, as
+	// the API server is not reachable.
+	err := kb.walRollback(context.Background(), &logical.Request{Storage: s}, secretWALKind,
+		&walSecret{Name: "vault-vault-abc", Namespace: "default", APIURL: c.APIURL})
+	assertNoError(t, err)
+	err = kb.walRollback(context.Background(), &logical.Request{Storage: s}, secretWALKind,
+		&walSecret{Name: "vault-vault-def", Namespace: "default", APIURL: c.APIURL})
+	if err == nil {
+		t.Errorf("Secret which doesn't back the stored token must be rolled back")
+	}
+}
@@ -23,18 +23,79 @@ func TestConfig(t *testing.T) {
 		"max-ttl": int64(3600),
 		"api-url": "https://localhost:8443/",
 		"CA":      "aGVsbG8K",
+
+		"kubeconfig-cluster-name-template": defaultKubeconfigClusterTemplate,
+		"kubeconfig-user-name-template":    defaultKubeconfigUserTemplate,
+		"kubeconfig-context-name-template": defaultKubeconfigContextTemplate,
+
+		"token-wait-timeout": int64(10),
+
+		"rotation-period":     int64(0),
+		"rotation-window":     int64(0),
+		"rotation-failures":   0,
+		"last-rotation-error": "",
 	}
+	cfg, err := getConfig(context.Background(), reqStorage)
+	assertNoError(t, err)
+	expected["last-rotated"] = formatTime(cfg.LastRotated)
 
 	testConfigRead(t, b, reqStorage, expected)
 
 	testConfigUpdate(t, b, reqStorage, map[string]interface{}{
 		"api-url": "https://127.0.0.1:8443/",
 		"ttl":     "50s",
+
+		"token-wait-timeout": "30s",
 	})
 
 	expected["ttl"] = int64(50)
+	expected["token-wait-timeout"] = int64(30)
 	expected["api-url"] = "https://127.0.0.1:8443/"
 	testConfigRead(t, b, reqStorage, expected)
+
+	testConfigUpdate(t, b, reqStorage, map[string]interface{}{
+		"kubeconfig-context-name-template": "{{.Namespace}}",
+	})
+
+	expected["kubeconfig-context-name-template"] = "{{.Namespace}}"
+	testConfigRead(t, b, reqStorage, expected)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"kubeconfig-user-name-template": "{{.Unknown}}",
+		},
+		Storage: reqStorage,
+	})
+	assertNoError(t, err)
+	if resp == nil || !resp.IsError() {
+		t.Errorf("Template with unknown field should be rejected")
+	}
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"rotation-period": "1h",
+			"rotation-window": "2h",
+		},
+		Storage: reqStorage,
+	})
+	assertNoError(t, err)
+	e := "rotation-window must be shorter than rotation-period"
+	if resp == nil || resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%v'", e, resp)
+	}
+
+	testConfigUpdate(t, b, reqStorage, map[string]interface{}{
+		"rotation-period": "720h",
+		"rotation-window": "24h",
+	})
+
+	expected["rotation-period"] = int64(720 * 3600)
+	expected["rotation-window"] = int64(24 * 3600)
+	testConfigRead(t, b, reqStorage, expected)
 }
 
 func testConfigUpdate(t *testing.T, b logical.Backend, s logical.Storage, d map[string]interface{}) {
@@ -2,10 +2,16 @@ package backend
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 func TestSecretsUpdateNotFound(t *testing.T) {
@@ -110,3 +116,869 @@ func TestSecretsUpdate(t *testing.T) {
 	assertEquals(t, resp.Data["namespace"].(string), "test", "")
 	assertEquals(t, resp.Data["CA_base64"].(string), "test", "")
 }
+
+func TestSecretsUpdateTokenRequest(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	request := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"api-url": "https://localhost:8443",
+			"token":   "123qwe",
+			"CA":      "abc",
+		},
+		Storage: s,
+	}
+	assertNoErrorRequest(t, b, request)
+
+	request = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":            "test",
+			"service-account-name": "test",
+			"token-type":           tokenTypeTokenRequest,
+		},
+		Storage: s,
+	}
+	assertNoErrorRequest(t, b, request)
+
+	request = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", secretsStoragePrefix),
+		Data:      nil,
+		Storage:   s,
+	}
+
+	resp := assertNoErrorRequest(t, b, request)
+	assertEquals(t, resp.Data["token"].(string), "test", "")
+	assertEquals(t, resp.Data["namespace"].(string), "test", "")
+	assertEquals(t, resp.Secret.InternalData["token-type"], tokenTypeTokenRequest, "")
+
+	// There is no Secret behind the token, so revocation should not touch the cluster
+	_, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	assertNoError(t, err)
+}
+
+func TestSecretsUpdateTokenRequestOptions(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"api-url": "https://localhost:8443",
+			"token":   "123qwe",
+			"CA":      "abc",
+		},
+		Storage: s,
+	})
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":            "test",
+			"service-account-name": "test",
+			"token-type":           tokenTypeTokenRequest,
+			"audiences":            "webhook,vault",
+		},
+		Storage: s,
+	})
+
+	cases := map[string]map[string]interface{}{
+		"Audience 'other' is not allowed for ServiceAccount 'test'": {
+			"audiences": "webhook,other",
+		},
+		"bound-object-kind must be 'Pod' or 'Secret'": {
+			"bound-object-kind": "Deployment",
+			"bound-object-name": "test",
+		},
+		"bound-object-name is required when bound-object-kind is set": {
+			"bound-object-kind": "Pod",
+		},
+	}
+	for e, data := range cases {
+		resp, _ := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      fmt.Sprintf("%s/test", secretsStoragePrefix),
+			Data:      data,
+			Storage:   s,
+		})
+		if resp.Error().Error() != e {
+			t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+		}
+	}
+
+	resp := assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", secretsStoragePrefix),
+		Data: map[string]interface{}{
+			"audiences":         "webhook",
+			"bound-object-kind": "Pod",
+			"bound-object-name": "runner",
+		},
+		Storage: s,
+	})
+	assertEquals(t, resp.Data["token"].(string), "test", "")
+}
+
+func TestSecretsUpdateKubeconfig(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"api-url":                          "https://localhost:8443",
+			"token":                            "123qwe",
+			"CA":                               "aGVsbG8K",
+			"kubeconfig-cluster-name-template": "dev",
+		},
+		Storage: s,
+	})
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":            "my-namespace",
+			"service-account-name": "deploy-bot",
+		},
+		Storage: s,
+	})
+
+	resp := assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", secretsStoragePrefix),
+		Data: map[string]interface{}{
+			"output-format": outputFormatKubeconfig,
+		},
+		Storage: s,
+	})
+
+	kubeconfig, err := clientcmd.Load([]byte(resp.Data["kubeconfig"].(string)))
+	assertNoError(t, err)
+	assertEquals(t, kubeconfig.CurrentContext, "test@localhost:8443", "")
+	kubeContext := kubeconfig.Contexts[kubeconfig.CurrentContext]
+	assertEquals(t, kubeContext.Cluster, "dev", "")
+	assertEquals(t, kubeContext.Namespace, "my-namespace", "")
+	assertEquals(t, kubeconfig.Clusters["dev"].Server, "https://localhost:8443", "")
+	assertEquals(t, string(kubeconfig.Clusters["dev"].CertificateAuthorityData), "hello\n", "")
+	assertEquals(t, kubeconfig.AuthInfos[kubeContext.AuthInfo].Token, "test", "")
+
+	resp = assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", secretsStoragePrefix),
+		Data: map[string]interface{}{
+			"output-format": outputFormatKubeconfigJSON,
+		},
+		Storage: s,
+	})
+	var kubeconfigJSON map[string]interface{}
+	assertNoError(t, json.Unmarshal([]byte(resp.Data["kubeconfig"].(string)), &kubeconfigJSON))
+	assertEquals(t, kubeconfigJSON["current-context"], "test@localhost:8443", "")
+}
+
+func TestSecretsUpdateDynamic(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"api-url": "https://localhost:8443",
+			"token":   "123qwe",
+			"CA":      "abc",
+		},
+		Storage: s,
+	})
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/deploy_bot", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":    "test",
+			"binding-type": bindingTypeDynamic,
+			"cluster-role": "edit",
+		},
+		Storage: s,
+	})
+
+	resp := assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/deploy_bot", secretsStoragePrefix),
+		Storage:   s,
+	})
+	assertEquals(t, resp.Data["token"].(string), "test", "")
+
+	dynamic := dynamicServiceAccountFromInternalData(resp.Secret.InternalData)
+	if dynamic == nil {
+		t.Fatal("Lease of dynamic binding should reference created ServiceAccount")
+	}
+	if !strings.HasPrefix(dynamic.ServiceAccountName, "vault-deploy-bot-") {
+		t.Errorf("Unexpected ServiceAccount name '%s'", dynamic.ServiceAccountName)
+	}
+	assertEquals(t, dynamic.RoleName, "", "Role should not be created for existing ClusterRole")
+	assertEquals(t, dynamic.RoleBindingName, dynamic.ServiceAccountName, "")
+
+	// WAL entry should be committed after successful issuance
+	walIDs, err := framework.ListWAL(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, len(walIDs), 0, "")
+}
+
+func TestSecretsUpdateCertificate(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	request := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"api-url": "https://localhost:8443",
+			"token":   "123qwe",
+			"CA":      "aGVsbG8K",
+		},
+		Storage: s,
+	}
+	assertNoErrorRequest(t, b, request)
+
+	request = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":  "test",
+			"token-type": tokenTypeCertificate,
+		},
+		Storage: s,
+	}
+
+	e := "user-name is required for token-type 'certificate'"
+	resp, _ := b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.Data["user-name"] = "jane"
+	request.Data["groups"] = "developers,oncall"
+	assertNoErrorRequest(t, b, request)
+
+	resp = assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", secretsStoragePrefix),
+		Data: map[string]interface{}{
+			"output-format": outputFormatKubeconfig,
+		},
+		Storage: s,
+	})
+	if !strings.Contains(resp.Data["private_key"].(string), "EC PRIVATE KEY") {
+		t.Errorf("Private key must be returned, get '%s'", resp.Data["private_key"])
+	}
+	assertEquals(t, resp.Secret.InternalData["token-type"], tokenTypeCertificate, "")
+	assertEquals(t, resp.Secret.Renewable, false, "Certificate leases can't outlive the certificate")
+
+	kubeconfig, err := clientcmd.Load([]byte(resp.Data["kubeconfig"].(string)))
+	assertNoError(t, err)
+	authInfo := kubeconfig.AuthInfos[kubeconfig.Contexts[kubeconfig.CurrentContext].AuthInfo]
+	assertEquals(t, string(authInfo.ClientCertificateData), "test", "")
+	assertEquals(t, authInfo.Token, "", "")
+
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	assertNoError(t, err)
+
+	request.Data = map[string]interface{}{
+		"token-type": tokenTypeSecret,
+	}
+	e = "user-name and groups can only be used with token-type 'certificate'"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+}
+
+func TestSecretsUpdateCertificateIdentity(t *testing.T) {
+	b, s := getTestBackend(t)
+	system := b.(*kubeBackend).System().(*logical.StaticSystemView)
+	system.EntityVal = &logical.Entity{ID: "entity-id", Name: "jane"}
+	system.GroupsVal = []*logical.Group{{ID: "1", Name: "developers"}, {ID: "2", Name: "oncall"}}
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"api-url": "https://localhost:8443",
+			"token":   "123qwe",
+			"CA":      "aGVsbG8K",
+		},
+		Storage: s,
+	})
+
+	request := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":  "test",
+			"token-type": tokenTypeCertificate,
+			"user-name":  "{{identity.entity.name",
+		},
+		Storage: s,
+	}
+	resp, _ := b.HandleRequest(context.Background(), request)
+	if resp == nil || !resp.IsError() {
+		t.Errorf("Invalid template must be rejected")
+	}
+
+	request.Data["user-name"] = "vault:{{identity.entity.name}}"
+	request.Data["groups"] = "{{identity.groups.names}},vault-users"
+	assertNoErrorRequest(t, b, request)
+
+	request = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", secretsStoragePrefix),
+		Storage:   s,
+	}
+	e := "ServiceAccount 'test' uses identity templates, but the request has no entity"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.EntityID = "entity-id"
+	sa, errResp, err := b.(*kubeBackend).withIdentity(request, &ServiceAccount{
+		Name:     "test",
+		UserName: "vault:{{identity.entity.name}}",
+		Groups:   []string{"{{identity.groups.names}}", "vault-users"},
+	})
+	assertNoError(t, err)
+	assertEquals(t, errResp, (*logical.Response)(nil), "")
+	assertEquals(t, sa.UserName, "vault:jane", "")
+	assertEquals(t, strings.Join(sa.Groups, ","), "developers,oncall,vault-users", "")
+
+	assertNoErrorRequest(t, b, request)
+}
+
+func TestSecretsUpdateGrant(t *testing.T) {
+	b, s := getTestBackend(t)
+	system := b.(*kubeBackend).System().(*logical.StaticSystemView)
+	system.EntityVal = &logical.Entity{ID: "entity-id", Name: "jane"}
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"api-url": "https://localhost:8443",
+			"token":   "123qwe",
+			"CA":      "aGVsbG8K",
+		},
+		Storage: s,
+	})
+
+	request := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/break-glass", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":    "production",
+			"binding-type": bindingTypeGrant,
+			"subject-kind": "User",
+			"subject-name": "oidc:{{identity.entity.name}}",
+		},
+		Storage: s,
+	}
+
+	e := "cluster-role is required and rules can't be used for 'grant' binding-type"
+	resp, _ := b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.Data["cluster-role"] = "admin"
+	assertNoErrorRequest(t, b, request)
+
+	request = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/break-glass", secretsStoragePrefix),
+		Data: map[string]interface{}{
+			"output-format": outputFormatKubeconfig,
+		},
+		EntityID: "entity-id",
+		Storage:  s,
+	}
+	e = "output-format 'kubeconfig' can't be used with 'grant' binding-type, no credential is issued"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.Data = nil
+	resp = assertNoErrorRequest(t, b, request)
+	assertEquals(t, resp.Data["subject-name"], "oidc:jane", "")
+	assertEquals(t, resp.Data["cluster-role"], "admin", "")
+	if _, ok := resp.Data["token"]; ok {
+		t.Errorf("Grant must not issue a credential")
+	}
+	if grantFromInternalData(resp.Secret.InternalData) == nil {
+		t.Errorf("Lease must remember the RoleBinding to delete it on revoke")
+	}
+
+	_, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	assertNoError(t, err)
+}
+
+func TestSecretsRenew(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"api-url": "https://localhost:8443",
+			"token":   "123qwe",
+			"CA":      "abc",
+		},
+		Storage: s,
+	})
+
+	request := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":            "test",
+			"service-account-name": "test",
+			"ttl":                  300,
+			"max-ttl":              200,
+		},
+		Storage: s,
+	}
+
+	e := "ttl can't be greater than max-ttl"
+	resp, _ := b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.Data["ttl"] = 100
+	assertNoErrorRequest(t, b, request)
+
+	e = "Max TTL configured to '200', you try to create TTL '500'"
+	resp, _ = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", secretsStoragePrefix),
+		Data: map[string]interface{}{
+			"ttl": 500,
+		},
+		Storage: s,
+	})
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	resp = assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", secretsStoragePrefix),
+		Storage:   s,
+	})
+	assertEquals(t, resp.Secret.TTL, 100*time.Second, "Binding TTL must override config")
+	assertEquals(t, resp.Secret.MaxTTL, 200*time.Second, "")
+
+	// Renewal can't extend the lease beyond max-ttl counted from issue time
+	secret := resp.Secret
+	secret.IssueTime = time.Now().Add(-150 * time.Second)
+	resp = assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.RenewOperation,
+		Secret:    secret,
+		Storage:   s,
+	})
+	if resp.Secret.TTL > 50*time.Second || resp.Secret.TTL < 49*time.Second {
+		t.Errorf("TTL must be capped to the rest of max-ttl, get '%s'", resp.Secret.TTL)
+	}
+
+	secret.IssueTime = time.Now().Add(-250 * time.Second)
+	_, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RenewOperation,
+		Secret:    secret,
+		Storage:   s,
+	})
+	if err == nil {
+		t.Errorf("Lease past max-ttl must not be renewed")
+	}
+
+	// TokenRequest tokens can't be renewed past their expiration in Kubernetes
+	request.Data = map[string]interface{}{
+		"token-type": tokenTypeTokenRequest,
+		"ttl":        60,
+		"max-ttl":    7200,
+	}
+	assertNoErrorRequest(t, b, request)
+	resp = assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", secretsStoragePrefix),
+		Storage:   s,
+	})
+	secret = resp.Secret
+	secret.IssueTime = time.Now()
+	secret.Increment = time.Hour
+	resp = assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.RenewOperation,
+		Secret:    secret,
+		Storage:   s,
+	})
+	if resp.Secret.TTL > minTokenExpiration {
+		t.Errorf("TTL must be capped to token expiration, get '%s'", resp.Secret.TTL)
+	}
+}
+
+func TestSecretsUpdateNamespace(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	request := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"api-url": "https://localhost:8443",
+			"token":   "123qwe",
+			"CA":      "abc",
+		},
+		Storage: s,
+	}
+	assertNoErrorRequest(t, b, request)
+
+	request = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":            "test",
+			"service-account-name": "test",
+		},
+		Storage: s,
+	}
+	assertNoErrorRequest(t, b, request)
+
+	request = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", secretsStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace": "other",
+		},
+		Storage: s,
+	}
+	e := "ServiceAccount 'test' is bound to namespace 'test'"
+	resp, _ := b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/preview", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":            "test",
+			"service-account-name": "test",
+			"allowed-namespaces":   "preview-*",
+		},
+		Storage: s,
+	}
+	e = "namespace 'test' doesn't match allowed-namespaces"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.Data = map[string]interface{}{
+		"service-account-name": "test",
+		"namespace-selector":   "env in (preview",
+	}
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp == nil || !resp.IsError() {
+		t.Errorf("Invalid namespace-selector must be rejected")
+	}
+
+	request.Data = map[string]interface{}{
+		"service-account-name": "test",
+		"allowed-namespaces":   "preview-*,staging",
+	}
+	assertNoErrorRequest(t, b, request)
+
+	request = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/preview", secretsStoragePrefix),
+		Storage:   s,
+	}
+	e = "namespace is required, ServiceAccount 'preview' has no default namespace"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.Data = map[string]interface{}{
+		"namespace": "production",
+	}
+	e = "Namespace 'production' is not allowed for ServiceAccount 'preview'"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	for _, namespace := range []string{"preview-42", "staging"} {
+		request.Data = map[string]interface{}{
+			"namespace": namespace,
+		}
+		resp = assertNoErrorRequest(t, b, request)
+		assertEquals(t, resp.Secret.InternalData["namespace"].(string), namespace, "")
+	}
+}
+
+func TestSecretsUpdateNamespaceIdentity(t *testing.T) {
+	b, s := getTestBackend(t)
+	system := b.(*kubeBackend).System().(*logical.StaticSystemView)
+	system.EntityVal = &logical.Entity{
+		ID:   "entity-id",
+		Name: "team-a-app",
+		Aliases: []*logical.Alias{{
+			MountAccessor: "auth_kubernetes_1",
+			Name:          "app-uid",
+			Metadata: map[string]string{
+				"service_account_namespace": "team-a",
+				"service_account_name":      "app",
+			},
+		}},
+	}
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"api-url": "https://localhost:8443",
+			"token":   "123qwe",
+			"CA":      "abc",
+		},
+		Storage: s,
+	})
+
+	request := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/workload", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":            "{{identity.entity.aliases.auth_kubernetes_1.metadata.service_account_namespace",
+			"service-account-name": "{{identity.entity.aliases.auth_kubernetes_1.metadata.service_account_name}}",
+			"token-type":           tokenTypeTokenRequest,
+		},
+		Storage: s,
+	}
+	resp, _ := b.HandleRequest(context.Background(), request)
+	if resp == nil || !resp.IsError() {
+		t.Errorf("Invalid template must be rejected")
+	}
+
+	request.Data["namespace"] = "{{identity.entity.aliases.auth_kubernetes_1.metadata.service_account_namespace}}"
+	assertNoErrorRequest(t, b, request)
+
+	request = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/workload", secretsStoragePrefix),
+		Storage:   s,
+		EntityID:  "entity-id",
+	}
+	resp = assertNoErrorRequest(t, b, request)
+	assertEquals(t, resp.Data["namespace"].(string), "team-a", "")
+	assertEquals(t, resp.Secret.InternalData["service-account-name"].(string), "app", "")
+
+	request.Data = map[string]interface{}{
+		"namespace": "team-b",
+	}
+	e := "ServiceAccount 'workload' is bound to namespace 'team-a'"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	// Namespaces of the team, the default one comes from the alias
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/workload", saStoragePrefix),
+		Data: map[string]interface{}{
+			"allowed-namespaces": "{{identity.entity.aliases.auth_kubernetes_1.metadata.service_account_namespace}}-*",
+		},
+		Storage: s,
+	})
+	e = "Namespace 'team-a' is not allowed for ServiceAccount 'workload'"
+	request.Data = nil
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.Data = map[string]interface{}{
+		"namespace": "team-a-preview",
+	}
+	resp = assertNoErrorRequest(t, b, request)
+	assertEquals(t, resp.Data["namespace"].(string), "team-a-preview", "")
+
+	request.Data["namespace"] = "team-b-preview"
+	e = "Namespace 'team-b-preview' is not allowed for ServiceAccount 'workload'"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	// Values of the entity can't widen allowed namespaces
+	system.EntityVal.Aliases[0].Metadata["service_account_namespace"] = "*"
+	e = "namespace '*' rendered from '{{identity.entity.aliases.auth_kubernetes_1.metadata.service_account_namespace}}' is not a valid namespace name"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+	_, errResp, err := b.(*kubeBackend).withIdentity(request, &ServiceAccount{
+		Name:              "workload",
+		AllowedNamespaces: []string{"{{identity.entity.aliases.auth_kubernetes_1.metadata.service_account_namespace}}-*"},
+	})
+	assertNoError(t, err)
+	e = "allowed-namespaces entry '{{identity.entity.aliases.auth_kubernetes_1.metadata.service_account_namespace}}-*' rendered to '*-*' with a wildcard"
+	if errResp == nil || errResp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%v'", e, errResp)
+	}
+}
+
+func TestSecretsUpdateConcurrent(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"api-url": "https://localhost:8443",
+			"token":   "123qwe",
+			"CA":      "abc",
+		},
+		Storage: s,
+	})
+	for _, name := range []string{"first", "second"} {
+		assertNoErrorRequest(t, b, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      fmt.Sprintf("%s/%s", saStoragePrefix, name),
+			Data: map[string]interface{}{
+				"namespace":            "test",
+				"service-account-name": name,
+			},
+			Storage: s,
+		})
+	}
+
+	// Bindings are updated while credentials of the same and other bindings are issued
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		name := []string{"first", "second"}[i%2]
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assertNoErrorRequest(t, b, &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      fmt.Sprintf("%s/%s", secretsStoragePrefix, name),
+				Storage:   s,
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			assertNoErrorRequest(t, b, &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      fmt.Sprintf("%s/%s", saStoragePrefix, name),
+				Data: map[string]interface{}{
+					"ttl": 60,
+				},
+				Storage: s,
+			})
+		}()
+	}
+	wg.Wait()
+
+	records, err := listLeaseRecords(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, len(records), 20, "")
+}
+
+func TestCreds(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"api-url": "https://localhost:8443",
+			"token":   "123qwe",
+			"CA":      "abc",
+		},
+		Storage: s,
+	})
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":            "test",
+			"service-account-name": "test",
+		},
+		Storage: s,
+	})
+
+	request := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", credsPathPrefix),
+		Data: map[string]interface{}{
+			"ttl":      60,
+			"metadata": "pipeline=1234",
+		},
+		Storage: s,
+	}
+	resp := assertNoErrorRequest(t, b, request)
+	assertEquals(t, resp.Data["token"].(string), "test", "")
+	assertEquals(t, resp.Secret.TTL, time.Minute, "")
+
+	request.Data["metadata"] = "kubernetes.io/service-account.name=admin"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp == nil || !resp.IsError() {
+		t.Errorf("Invalid metadata key must be rejected")
+	}
+
+	// Reading must not issue credentials
+	_, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("%s/test", credsPathPrefix),
+		Storage:   s,
+	})
+	assertEquals(t, err, logical.ErrUnsupportedOperation, "")
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.HelpOperation,
+		Path:      fmt.Sprintf("%s/test", credsPathPrefix),
+		Storage:   s,
+	})
+	assertNoError(t, err)
+	doc, err := json.Marshal(resp.Data["openapi"])
+	assertNoError(t, err)
+	if !strings.Contains(string(doc), "private_key") {
+		t.Errorf("OpenAPI must describe response data, get %s", doc)
+	}
+}
+
+func TestIssuingPathsForwarded(t *testing.T) {
+	b := New()
+	for _, p := range []*framework.Path{pathCreds(b), pathSecrets(b)} {
+		for op, handler := range p.Operations {
+			properties := handler.Properties()
+			if !properties.ForwardPerformanceStandby || !properties.ForwardPerformanceSecondary {
+				t.Errorf("%s of %s issues credentials, it must be forwarded to the active node of the primary", op, p.Pattern)
+			}
+		}
+	}
+}
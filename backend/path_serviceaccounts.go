@@ -3,14 +3,29 @@ package backend
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"time"
 
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
 )
 
 const (
 	saStoragePrefix = "sa"
+
+	tokenTypeSecret       = "secret"
+	tokenTypeTokenRequest = "tokenrequest"
+	tokenTypeCertificate  = "certificate"
+
+	bindingTypeExisting = "existing"
+	bindingTypeDynamic  = "dynamic"
+	bindingTypeGrant    = "grant"
 )
 
 // ServiceAccount bind to Kubernetes ServiceAccount with ServiceAccountName and Namespace, all permissions are
@@ -19,6 +34,88 @@ type ServiceAccount struct {
 	Name               string
 	Namespace          string
 	ServiceAccountName string
+	// AllowedNamespaces (globs) and NamespaceSelector let creds requests pick namespace, Namespace is the default then
+	AllowedNamespaces []string
+	NamespaceSelector string
+	// Cluster is the name of connection in clusters/, empty for the default connection from config
+	Cluster string
+	// Clusters or ClusterSelector make the binding issue tokens in several clusters under a single lease
+	Clusters        []string
+	ClusterSelector string
+	// TokenType selects how tokens are issued: tokenTypeSecret creates a legacy
+	// ServiceAccount token Secret, tokenTypeTokenRequest uses the TokenRequest API, tokenTypeCertificate issues a
+	// client certificate for UserName and Groups through the CertificateSigningRequest API
+	TokenType string
+	// Audiences which creds requests are allowed to pick from, only used with tokenTypeTokenRequest
+	Audiences []string
+	// UserName and Groups are the identity of client certificates, only used with tokenTypeCertificate
+	UserName string
+	Groups   []string
+
+	// BindingType is bindingTypeExisting for ServiceAccount which already exists in Kubernetes, bindingTypeDynamic
+	// to create ServiceAccount with Rules or ClusterRole per lease or bindingTypeGrant to grant ClusterRole to an
+	// existing subject per lease without issuing any credential
+	BindingType   string
+	Rules         []rbacv1.PolicyRule
+	ClusterRole   string
+	ClusterScoped bool
+	// SubjectKind and SubjectName identify who gets ClusterRole, only used with bindingTypeGrant
+	SubjectKind string
+	SubjectName string
+
+	// TTL and MaxTTL override TTLs from config for leases of the binding, zero means config value
+	TTL    time.Duration
+	MaxTTL time.Duration
+}
+
+func (r *ServiceAccount) tokenType() string {
+	if r.TokenType == "" {
+		return tokenTypeSecret
+	}
+	return r.TokenType
+}
+
+// leaseTTLs returns default and max lease TTL of the binding, falling back to c. Zero values mean mount-tuned or
+// system defaults.
+func (r *ServiceAccount) leaseTTLs(c *config) (time.Duration, time.Duration) {
+	ttl, maxTTL := c.TTL, c.MaxTTL
+	if r.TTL > 0 {
+		ttl = r.TTL
+	}
+	if r.MaxTTL > 0 {
+		maxTTL = r.MaxTTL
+	}
+	return ttl, maxTTL
+}
+
+func (r *ServiceAccount) bindingType() string {
+	if r.BindingType == "" {
+		return bindingTypeExisting
+	}
+	return r.BindingType
+}
+
+// fanOut reports whether tokens are issued in several clusters at once
+func (r *ServiceAccount) fanOut() bool {
+	return len(r.Clusters) > 0 || r.ClusterSelector != ""
+}
+
+// usesCluster reports whether tokens of the binding are issued in cluster with labels
+func (r *ServiceAccount) usesCluster(cluster string, clusterLabels map[string]string) bool {
+	if !r.fanOut() {
+		return r.Cluster == cluster
+	}
+	if strutil.StrListContains(r.Clusters, cluster) {
+		return true
+	}
+	if r.ClusterSelector == "" || cluster == "" {
+		return false
+	}
+	selector, err := labels.Parse(r.ClusterSelector)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(labels.Set(clusterLabels))
 }
 
 func (r *ServiceAccount) save(ctx context.Context, s logical.Storage) error {
@@ -34,7 +131,24 @@ func (r *ServiceAccount) toResponse() *logical.Response {
 	return &logical.Response{
 		Data: map[string]interface{}{
 			"namespace":            r.Namespace,
+			"allowed-namespaces":   r.AllowedNamespaces,
+			"namespace-selector":   r.NamespaceSelector,
 			"service-account-name": r.ServiceAccountName,
+			"cluster":              r.Cluster,
+			"clusters":             r.Clusters,
+			"cluster-selector":     r.ClusterSelector,
+			"token-type":           r.tokenType(),
+			"audiences":            r.Audiences,
+			"user-name":            r.UserName,
+			"groups":               r.Groups,
+			"binding-type":         r.bindingType(),
+			"rules":                r.Rules,
+			"cluster-role":         r.ClusterRole,
+			"cluster-scoped":       r.ClusterScoped,
+			"subject-kind":         r.SubjectKind,
+			"subject-name":         r.SubjectName,
+			"ttl":                  int64(r.TTL / time.Second),
+			"max-ttl":              int64(r.MaxTTL / time.Second),
 		},
 	}
 }
@@ -54,6 +168,34 @@ func getServiceAccount(ctx context.Context, name string, s logical.Storage) (*Se
 	return sa, nil
 }
 
+// readServiceAccount gets binding name under its read lock, so a concurrent update is never read half way. The lock
+// is released before returning, callers work with a snapshot.
+func (b *kubeBackend) readServiceAccount(ctx context.Context, name string, s logical.Storage) (*ServiceAccount, error) {
+	lock := locksutil.LockForKey(b.saLocks, name)
+	lock.RLock()
+	defer lock.RUnlock()
+	return getServiceAccount(ctx, name, s)
+}
+
+// listServiceAccounts returns all bindings of the mount
+func listServiceAccounts(ctx context.Context, s logical.Storage) ([]*ServiceAccount, error) {
+	names, err := s.List(ctx, fmt.Sprintf("%s/", saStoragePrefix))
+	if err != nil {
+		return nil, err
+	}
+	var bindings []*ServiceAccount
+	for _, name := range names {
+		sa, err := getServiceAccount(ctx, name, s)
+		if err != nil {
+			return nil, err
+		}
+		if sa != nil {
+			bindings = append(bindings, sa)
+		}
+	}
+	return bindings, nil
+}
+
 func pathServiceAccountsList(b *kubeBackend) *framework.Path {
 	return &framework.Path{
 		Pattern: fmt.Sprintf("%s/?$", saStoragePrefix),
@@ -74,12 +216,107 @@ func pathServiceAccounts(b *kubeBackend) *framework.Path {
 				Description: "Required. Name of the Vault object",
 			},
 			"namespace": {
-				Type:        framework.TypeString,
-				Description: "Required. ServiceAccount's namespace",
+				Type: framework.TypeString,
+				Description: `Required unless allowed-namespaces or namespace-selector is set. ServiceAccount's
+namespace, the default one if requests may pick namespace. May be an identity template`,
+			},
+			"allowed-namespaces": {
+				Type: framework.TypeCommaStringSlice,
+				Description: `Optional. Globs of namespaces creds requests may pick with the namespace parameter, for
+example 'preview-*'. Entries may be identity templates`,
+			},
+			"namespace-selector": {
+				Type: framework.TypeString,
+				Description: `Optional. Label selector namespaces picked by creds requests must match, labels are
+checked in the cluster on every request`,
 			},
 			"service-account-name": {
 				Type:        framework.TypeString,
-				Description: "Required. Name of ServiceAccount in Kubernetes namespace",
+				Description: "Required for 'existing' binding-type. Name of ServiceAccount in Kubernetes namespace, may be an identity template",
+			},
+			"cluster": {
+				Type:        framework.TypeString,
+				Description: "Optional. Name of the cluster connection from clusters/, the connection from config by default",
+			},
+			"clusters": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Optional. Names of clusters to issue tokens in at once, a single lease covers all of them",
+			},
+			"cluster-selector": {
+				Type: framework.TypeString,
+				Description: `Optional. Label selector of clusters to issue tokens in at once, for example
+'env=prod,region in (us,eu)'`,
+			},
+			"binding-type": {
+				Type: framework.TypeString,
+				Description: `Optional. 'existing' (default) issues tokens for existing ServiceAccount, 'dynamic' creates
+ServiceAccount, Role and RoleBinding per lease and deletes them on revoke, 'grant' issues no credential and binds
+cluster-role to subject-name for the lease duration`,
+			},
+			"rules": {
+				Type: framework.TypeString,
+				Description: `Rules of the Role created for 'dynamic' binding-type, JSON or YAML list of Kubernetes
+PolicyRules. Either rules or cluster-role is required for 'dynamic' binding-type`,
+			},
+			"cluster-role": {
+				Type: framework.TypeString,
+				Description: `Existing ClusterRole granted to ServiceAccount of 'dynamic' binding-type instead of rules,
+required for 'grant' binding-type`,
+			},
+			"cluster-scoped": {
+				Type: framework.TypeBool,
+				Description: `Optional. Grant permissions of 'dynamic' and 'grant' binding-types in all namespaces
+through ClusterRole and ClusterRoleBinding instead of Role and RoleBinding`,
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Optional. Default lease TTL of the binding, ttl from config by default",
+			},
+			"max-ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Optional. Maximum lifetime of leases of the binding including renewals, max-ttl from config by default",
+			},
+			"subject-kind": {
+				Type:        framework.TypeString,
+				Description: "Required for 'grant' binding-type. Kind of the subject: 'User', 'Group' or 'ServiceAccount'",
+			},
+			"subject-name": {
+				Type: framework.TypeString,
+				Description: `Required for 'grant' binding-type. Name of the user, group or ServiceAccount in namespace
+cluster-role is granted to, may use identity templates like '{{identity.entity.name}}'`,
+			},
+			"token-type": {
+				Type: framework.TypeString,
+				Description: `Optional. How tokens are issued: 'secret' (default) creates a ServiceAccount token Secret,
+'tokenrequest' uses the TokenRequest API and the token expires on its own with the lease, 'certificate' issues a
+client certificate for user-name and groups through the CertificateSigningRequest API`,
+			},
+			"audiences": {
+				Type: framework.TypeCommaStringSlice,
+				Description: `Optional. Audiences the token may be issued for, a request picks a subset of them. Only
+used with token-type 'tokenrequest', empty means the API server default audience`,
+			},
+			"user-name": {
+				Type: framework.TypeString,
+				Description: `Required for 'certificate' token-type. User name (certificate common name) Kubernetes
+authenticates, may use identity templates like '{{identity.entity.name}}'`,
+			},
+			"groups": {
+				Type: framework.TypeCommaStringSlice,
+				Description: `Optional. Groups (certificate organizations) of the user, only used with 'certificate'
+token-type. Entries may use identity templates, '{{identity.entity.groups.names}}' expands to all groups of the
+requesting entity`,
+			},
+			"verify-connection": {
+				Type: framework.TypeBool,
+				Description: `Check in Kubernetes that namespace and ServiceAccount exist and the plugin may issue tokens
+there before the binding is stored. Missing objects fail the write, denied permissions are returned as warnings`,
+				Default: true,
+			},
+			"create-if-missing": {
+				Type: framework.TypeBool,
+				Description: `Optional. Create ServiceAccount of 'existing' binding-type in namespace if it doesn't exist
+yet. The ServiceAccount is not deleted with the binding, but it's deleted again if the write fails`,
 			},
 		},
 		// ExistenceCheck: b.pathRoleSetExistenceCheck,
@@ -94,8 +331,6 @@ func pathServiceAccounts(b *kubeBackend) *framework.Path {
 }
 
 func (b *kubeBackend) pathServiceAccountList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	b.saMutex.RLock()
-	defer b.saMutex.RUnlock()
 	list, err := req.Storage.List(ctx, fmt.Sprintf("%s/", saStoragePrefix))
 	if err != nil {
 		return nil, err
@@ -103,58 +338,311 @@ func (b *kubeBackend) pathServiceAccountList(ctx context.Context, req *logical.R
 	return logical.ListResponse(list), nil
 }
 
-func (b *kubeBackend) pathServiceAccountCreateUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	b.saMutex.Lock()
-	defer b.saMutex.Unlock()
-	new := false
-	nameRaw, ok := d.GetOk("name")
-	if !ok {
-		return logical.ErrorResponse("name is required"), nil
+// applyServiceAccountFields validates fields of the request and applies them to a copy of stored binding name, nil
+// stored starts a new binding. Stored binding is left intact, so it may be a snapshot read without the lock.
+func applyServiceAccountFields(ctx context.Context, s logical.Storage, name string, stored *ServiceAccount, d *framework.FieldData) (*ServiceAccount, *logical.Response, error) {
+	new := stored == nil
+	sa := &ServiceAccount{Name: name}
+	if !new {
+		copied := *stored
+		sa = &copied
 	}
 
-	name := nameRaw.(string)
-
-	sa, err := getServiceAccount(ctx, name, req.Storage)
-	if err != nil {
-		return nil, err
+	allowedNamespacesRaw, ok := d.GetOk("allowed-namespaces")
+	if ok {
+		sa.AllowedNamespaces = allowedNamespacesRaw.([]string)
+		for _, tpl := range sa.AllowedNamespaces {
+			if err := validateIdentityTemplate(tpl); err != nil {
+				return nil, logical.ErrorResponse(fmt.Sprintf("allowed-namespaces entry '%s' is invalid: %s", tpl, err)), nil
+			}
+		}
 	}
 
-	if sa == nil {
-		new = true
-		sa = &ServiceAccount{
-			Name: nameRaw.(string),
+	namespaceSelectorRaw, ok := d.GetOk("namespace-selector")
+	if ok {
+		sa.NamespaceSelector = namespaceSelectorRaw.(string)
+		if _, err := labels.Parse(sa.NamespaceSelector); err != nil {
+			return nil, logical.ErrorResponse(fmt.Sprintf("namespace-selector is invalid: %s", err)), nil
 		}
 	}
 
 	namespaceRaw, ok := d.GetOk("namespace")
 	if ok {
 		sa.Namespace = namespaceRaw.(string)
-	} else if !ok && new {
-		return logical.ErrorResponse("namespace is required"), nil
+	} else if !ok && new && !sa.namespaceRestricted() {
+		return nil, logical.ErrorResponse("namespace is required"), nil
+	}
+	if err := validateIdentityTemplate(sa.Namespace); err != nil {
+		return nil, logical.ErrorResponse(fmt.Sprintf("namespace '%s' is invalid: %s", sa.Namespace, err)), nil
+	}
+	// Templated namespace is checked against allowed-namespaces once rendered for the request
+	if sa.Namespace != "" && !isIdentityTemplate(sa.Namespace) && !sa.namespaceMatchesPatterns(sa.Namespace) {
+		return nil, logical.ErrorResponse(fmt.Sprintf("namespace '%s' doesn't match allowed-namespaces", sa.Namespace)), nil
+	}
+
+	clusterRaw, ok := d.GetOk("cluster")
+	if ok {
+		sa.Cluster = clusterRaw.(string)
+		if sa.Cluster != "" {
+			conn, err := getConnection(ctx, s, sa.Cluster)
+			if err != nil {
+				return nil, nil, err
+			}
+			if conn == nil {
+				return nil, logical.ErrorResponse(fmt.Sprintf("Cluster '%s' not found", sa.Cluster)), nil
+			}
+		}
+	}
+
+	clustersRaw, ok := d.GetOk("clusters")
+	if ok {
+		sa.Clusters = clustersRaw.([]string)
+		for _, cluster := range sa.Clusters {
+			conn, err := getConnection(ctx, s, cluster)
+			if err != nil {
+				return nil, nil, err
+			}
+			if cluster == "" || conn == nil {
+				return nil, logical.ErrorResponse(fmt.Sprintf("Cluster '%s' not found", cluster)), nil
+			}
+		}
+	}
+
+	clusterSelectorRaw, ok := d.GetOk("cluster-selector")
+	if ok {
+		sa.ClusterSelector = clusterSelectorRaw.(string)
+		if _, err := labels.Parse(sa.ClusterSelector); err != nil {
+			return nil, logical.ErrorResponse(fmt.Sprintf("cluster-selector is invalid: %s", err)), nil
+		}
+	}
+
+	if (sa.Cluster != "" && sa.fanOut()) || (len(sa.Clusters) > 0 && sa.ClusterSelector != "") {
+		return nil, logical.ErrorResponse("only one of cluster, clusters and cluster-selector can be set"), nil
+	}
+
+	bindingTypeRaw, ok := d.GetOk("binding-type")
+	if ok {
+		switch bindingType := bindingTypeRaw.(string); bindingType {
+		case bindingTypeExisting, bindingTypeDynamic, bindingTypeGrant:
+			sa.BindingType = bindingType
+		default:
+			return nil, logical.ErrorResponse(fmt.Sprintf("binding-type must be '%s', '%s' or '%s'",
+				bindingTypeExisting, bindingTypeDynamic, bindingTypeGrant)), nil
+		}
+	}
+
+	tokenTypeRaw, ok := d.GetOk("token-type")
+	if ok {
+		switch tokenType := tokenTypeRaw.(string); tokenType {
+		case tokenTypeSecret, tokenTypeTokenRequest, tokenTypeCertificate:
+			sa.TokenType = tokenType
+		default:
+			return nil, logical.ErrorResponse(fmt.Sprintf("token-type must be '%s', '%s' or '%s'",
+				tokenTypeSecret, tokenTypeTokenRequest, tokenTypeCertificate)), nil
+		}
 	}
 
 	saNameRaw, ok := d.GetOk("service-account-name")
 	if ok {
 		sa.ServiceAccountName = saNameRaw.(string)
-	} else if !ok && new {
-		return logical.ErrorResponse("service-account-name is required"), nil
+		if err := validateIdentityTemplate(sa.ServiceAccountName); err != nil {
+			return nil, logical.ErrorResponse(fmt.Sprintf("service-account-name '%s' is invalid: %s", sa.ServiceAccountName, err)), nil
+		}
+	}
+
+	rulesRaw, ok := d.GetOk("rules")
+	if ok {
+		var rules []rbacv1.PolicyRule
+		if err := yaml.Unmarshal([]byte(rulesRaw.(string)), &rules); err != nil {
+			return nil, logical.ErrorResponse(fmt.Sprintf("unable to parse rules: %s", err)), nil
+		}
+		sa.Rules = rules
+	}
+
+	clusterRoleRaw, ok := d.GetOk("cluster-role")
+	if ok {
+		sa.ClusterRole = clusterRoleRaw.(string)
+	}
+
+	clusterScopedRaw, ok := d.GetOk("cluster-scoped")
+	if ok {
+		sa.ClusterScoped = clusterScopedRaw.(bool)
+	}
+
+	subjectKindRaw, ok := d.GetOk("subject-kind")
+	if ok {
+		switch subjectKind := subjectKindRaw.(string); subjectKind {
+		case subjectKindUser, subjectKindGroup, subjectKindServiceAccount:
+			sa.SubjectKind = subjectKind
+		default:
+			return nil, logical.ErrorResponse(fmt.Sprintf("subject-kind must be '%s', '%s' or '%s'",
+				subjectKindUser, subjectKindGroup, subjectKindServiceAccount)), nil
+		}
+	}
+
+	subjectNameRaw, ok := d.GetOk("subject-name")
+	if ok {
+		sa.SubjectName = subjectNameRaw.(string)
+	}
+
+	switch sa.bindingType() {
+	case bindingTypeDynamic:
+		if (len(sa.Rules) == 0) == (sa.ClusterRole == "") {
+			return nil, logical.ErrorResponse("either rules or cluster-role is required for 'dynamic' binding-type"), nil
+		}
+	case bindingTypeGrant:
+		if sa.ClusterRole == "" || len(sa.Rules) > 0 {
+			return nil, logical.ErrorResponse("cluster-role is required and rules can't be used for 'grant' binding-type"), nil
+		}
+		if sa.SubjectKind == "" || sa.SubjectName == "" {
+			return nil, logical.ErrorResponse("subject-kind and subject-name are required for 'grant' binding-type"), nil
+		}
+		if err := validateIdentityTemplate(sa.SubjectName); err != nil {
+			return nil, logical.ErrorResponse(fmt.Sprintf("template '%s' is invalid: %s", sa.SubjectName, err)), nil
+		}
+		if sa.TokenType != "" {
+			return nil, logical.ErrorResponse("token-type can't be used with 'grant' binding-type, no credential is issued"), nil
+		}
+	default:
+		if len(sa.Rules) > 0 || sa.ClusterRole != "" || sa.ClusterScoped {
+			return nil, logical.ErrorResponse("rules, cluster-role and cluster-scoped can only be used with 'dynamic' and 'grant' binding-types"), nil
+		}
+	}
+	if sa.bindingType() != bindingTypeGrant && (sa.SubjectKind != "" || sa.SubjectName != "") {
+		return nil, logical.ErrorResponse("subject-kind and subject-name can only be used with 'grant' binding-type"), nil
+	}
+
+	audiencesRaw, ok := d.GetOk("audiences")
+	if ok {
+		sa.Audiences = audiencesRaw.([]string)
+	}
+
+	if len(sa.Audiences) > 0 && sa.tokenType() != tokenTypeTokenRequest {
+		return nil, logical.ErrorResponse(fmt.Sprintf("audiences can only be used with token-type '%s'", tokenTypeTokenRequest)), nil
+	}
+
+	userNameRaw, ok := d.GetOk("user-name")
+	if ok {
+		sa.UserName = userNameRaw.(string)
+	}
+
+	groupsRaw, ok := d.GetOk("groups")
+	if ok {
+		sa.Groups = groupsRaw.([]string)
 	}
 
-	if err := sa.save(ctx, req.Storage); err != nil {
+	if sa.tokenType() == tokenTypeCertificate {
+		if sa.UserName == "" {
+			return nil, logical.ErrorResponse(fmt.Sprintf("user-name is required for token-type '%s'", tokenTypeCertificate)), nil
+		}
+		if sa.bindingType() != bindingTypeExisting {
+			return nil, logical.ErrorResponse(fmt.Sprintf("token-type '%s' can't be used with '%s' binding-type", tokenTypeCertificate, sa.bindingType())), nil
+		}
+		for _, tpl := range append([]string{sa.UserName}, sa.Groups...) {
+			if err := validateIdentityTemplate(tpl); err != nil {
+				return nil, logical.ErrorResponse(fmt.Sprintf("template '%s' is invalid: %s", tpl, err)), nil
+			}
+		}
+	} else if sa.UserName != "" || len(sa.Groups) > 0 {
+		return nil, logical.ErrorResponse(fmt.Sprintf("user-name and groups can only be used with token-type '%s'", tokenTypeCertificate)), nil
+	}
+
+	// Checked once all fields are applied, an update may switch binding-type or token-type of a stored binding
+	if sa.bindingType() == bindingTypeExisting && sa.tokenType() != tokenTypeCertificate && sa.ServiceAccountName == "" {
+		return nil, logical.ErrorResponse("service-account-name is required"), nil
+	}
+
+	ttlRaw, ok := d.GetOk("ttl")
+	if ok {
+		sa.TTL = time.Duration(ttlRaw.(int)) * time.Second
+	}
+
+	maxTTLRaw, ok := d.GetOk("max-ttl")
+	if ok {
+		sa.MaxTTL = time.Duration(maxTTLRaw.(int)) * time.Second
+	}
+
+	if sa.TTL > 0 && sa.MaxTTL > 0 && sa.TTL > sa.MaxTTL {
+		return nil, logical.ErrorResponse("ttl can't be greater than max-ttl"), nil
+	}
+
+	return sa, nil, nil
+}
+
+func (b *kubeBackend) pathServiceAccountCreateUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	nameRaw, ok := d.GetOk("name")
+	if !ok {
+		return logical.ErrorResponse("name is required"), nil
+	}
+	name := nameRaw.(string)
+
+	// The binding is built and checked in Kubernetes without its lock, so creds requests aren't blocked by slow
+	// clusters. The lock only covers storage.
+	stored, err := b.readServiceAccount(ctx, name, req.Storage)
+	if err != nil {
 		return nil, err
 	}
+	sa, errResp, err := applyServiceAccountFields(ctx, req.Storage, name, stored, d)
+	if err != nil || errResp != nil {
+		return errResp, err
+	}
 
+	verify := d.Get("verify-connection").(bool)
+	createIfMissing := d.Get("create-if-missing").(bool)
+	if createIfMissing {
+		if !verify {
+			return logical.ErrorResponse("create-if-missing can't be used with verify-connection=false"), nil
+		}
+		if sa.bindingType() != bindingTypeExisting || sa.tokenType() == tokenTypeCertificate {
+			return logical.ErrorResponse("create-if-missing can only be used with 'existing' binding-type issuing ServiceAccount tokens"), nil
+		}
+		if sa.Namespace == "" || isIdentityTemplate(sa.Namespace) || isIdentityTemplate(sa.ServiceAccountName) {
+			return logical.ErrorResponse("create-if-missing needs namespace and service-account-name without identity templates"), nil
+		}
+	}
+
+	var warnings []string
+	var created []fanOutTarget
+	if verify {
+		warnings, created, errResp, err = b.verifyBinding(ctx, req.Storage, sa, createIfMissing)
+		if err != nil || errResp != nil {
+			return errResp, err
+		}
+	}
+
+	lock := locksutil.LockForKey(b.saLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+	stored, err = getServiceAccount(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	current, errResp, err := applyServiceAccountFields(ctx, req.Storage, name, stored, d)
+	if err == nil && errResp == nil && !reflect.DeepEqual(current, sa) {
+		// What is saved must be what was checked
+		errResp = logical.ErrorResponse(fmt.Sprintf("ServiceAccount '%s' was changed by another request while it was checked, retry the write", name))
+	}
+	if err != nil || errResp != nil {
+		// The binding isn't stored, so ServiceAccounts created for it must go
+		return b.failBindingWrite(sa, created, errResp, err)
+	}
+
+	if err := current.save(ctx, req.Storage); err != nil {
+		return b.failBindingWrite(sa, created, nil, err)
+	}
+
+	if len(warnings) > 0 {
+		return &logical.Response{Warnings: warnings}, nil
+	}
 	return nil, nil
 }
 
 func (b *kubeBackend) pathServiceAccountRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	b.saMutex.RLock()
-	defer b.saMutex.RUnlock()
 	nameRaw, ok := d.GetOk("name")
 	if !ok {
 		return logical.ErrorResponse("name is required"), nil
 	}
-	sa, err := getServiceAccount(ctx, nameRaw.(string), req.Storage)
+	sa, err := b.readServiceAccount(ctx, nameRaw.(string), req.Storage)
 	if err != nil {
 		return nil, err
 	}
@@ -165,13 +653,14 @@ func (b *kubeBackend) pathServiceAccountRead(ctx context.Context, req *logical.R
 }
 
 func (b *kubeBackend) pathServiceAccountDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	b.saMutex.Lock()
-	defer b.saMutex.Unlock()
 	nameRaw, ok := d.GetOk("name")
 	if !ok {
 		return logical.ErrorResponse("name is required"), nil
 	}
 	name := nameRaw.(string)
+	lock := locksutil.LockForKey(b.saLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
 	sa, err := getServiceAccount(ctx, name, req.Storage)
 	if err != nil {
 		return nil, errwrap.Wrapf(fmt.Sprintf("unable to get sa '%s': {{err}}", name), err)
@@ -188,4 +677,5 @@ func (b *kubeBackend) pathServiceAccountDelete(ctx context.Context, req *logical
 const pathServiceAccountHelpSyn = `Read/write ServiceAccount bindings Vault <-> Kubernetes.`
 const pathServiceAccountHelpDesc = `
 This path allow you create service account, which bind Kubernetes ServiceAccount. Vault will
-create Secrets for this ServiceAccount in Kubernetes.`
+create Secrets for this ServiceAccount in Kubernetes. With 'dynamic' binding-type Vault creates
+a new ServiceAccount with its Role and RoleBinding for every secret instead.`
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/hashicorp/vault/sdk/logical"
+	rbacv1 "k8s.io/api/rbac/v1"
 )
 
 func TestServiceAccountCreate(t *testing.T) {
@@ -34,6 +35,30 @@ func TestServiceAccountCreate(t *testing.T) {
 		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
 	}
 
+	request.Data = map[string]interface{}{
+		"namespace":            "test",
+		"service-account-name": "test",
+		"token-type":           "unknown",
+	}
+
+	e = "token-type must be 'secret', 'tokenrequest' or 'certificate'"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.Data = map[string]interface{}{
+		"namespace":            "test",
+		"service-account-name": "test",
+		"audiences":            "webhook",
+	}
+
+	e = "audiences can only be used with token-type 'tokenrequest'"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
 	request.Data = map[string]interface{}{
 		"namespace":            "test",
 		"service-account-name": "test",
@@ -166,3 +191,62 @@ func TestServiceAccountDelete(t *testing.T) {
 
 	assertNoErrorRequest(t, b, request)
 }
+
+func TestServiceAccountCreateDynamic(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	request := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/test", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":    "test",
+			"binding-type": bindingTypeDynamic,
+		},
+		Storage: s,
+	}
+
+	e := "either rules or cluster-role is required for 'dynamic' binding-type"
+	resp, _ := b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request.Data["rules"] = `[{"apiGroups": [""], "resources": ["pods"], "verbs": ["get", "list"]}]`
+	assertNoErrorRequest(t, b, request)
+
+	resp = assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      fmt.Sprintf("%s/test", saStoragePrefix),
+		Storage:   s,
+	})
+	rules := resp.Data["rules"].([]rbacv1.PolicyRule)
+	assertEquals(t, len(rules), 1, "")
+	assertEquals(t, rules[0].Resources[0], "pods", "")
+
+	request.Data = map[string]interface{}{
+		"binding-type": bindingTypeExisting,
+		"rules":        "",
+	}
+	e = "service-account-name is required"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+
+	request = &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      fmt.Sprintf("%s/existing", saStoragePrefix),
+		Data: map[string]interface{}{
+			"namespace":            "test",
+			"service-account-name": "test",
+			"cluster-role":         "view",
+		},
+		Storage: s,
+	}
+
+	e = "rules, cluster-role and cluster-scoped can only be used with 'dynamic' and 'grant' binding-types"
+	resp, _ = b.HandleRequest(context.Background(), request)
+	if resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get '%s'", e, resp.Error())
+	}
+}
@@ -0,0 +1,274 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	tidyStateInactive = "Inactive"
+	tidyStateRunning  = "Running"
+	tidyStateFinished = "Finished"
+	tidyStateError    = "Error"
+
+	defaultTidySafetyBuffer = time.Hour
+)
+
+// tidyStatus describes the last tidy operation, it's kept in memory only
+type tidyStatus struct {
+	State          string
+	DryRun         bool
+	SafetyBuffer   time.Duration
+	TimeStarted    time.Time
+	TimeFinished   time.Time
+	SecretsChecked int
+	Orphans        []string
+	OrphansDeleted int
+	// StaleLeases are IDs of lease records older than max lease TTL
+	StaleLeases []string
+	Error       string
+}
+
+func pathTidy(b *kubeBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "tidy$",
+		Fields: map[string]*framework.FieldSchema{
+			"dry-run": {
+				Type:        framework.TypeBool,
+				Description: "Optional. Only report Secrets without a lease, set to false to delete them",
+				Default:     true,
+			},
+			"safety-buffer": {
+				Type: framework.TypeDurationSecond,
+				Description: `Optional. Secrets created less than this long ago are skipped, their leases may still be
+on the way. Default is 1h`,
+				Default: int(defaultTidySafetyBuffer.Seconds()),
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathTidyUpdate,
+		},
+		HelpSynopsis:    pathTidyHelpSyn,
+		HelpDescription: pathTidyHelpDesc,
+	}
+}
+
+func pathTidyStatus(b *kubeBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "tidy-status$",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathTidyStatusRead,
+		},
+		HelpSynopsis:    pathTidyStatusHelpSyn,
+		HelpDescription: pathTidyStatusHelpDesc,
+	}
+}
+
+func (b *kubeBackend) pathTidyUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	dryRun := d.Get("dry-run").(bool)
+	safetyBuffer := time.Duration(d.Get("safety-buffer").(int)) * time.Second
+	if safetyBuffer <= 0 {
+		return logical.ErrorResponse("safety-buffer must be greater than zero"), nil
+	}
+
+	if !atomic.CompareAndSwapUint32(&b.tidyRunning, 0, 1) {
+		resp := &logical.Response{}
+		resp.AddWarning("Tidy operation already in progress.")
+		return resp, nil
+	}
+
+	status := &tidyStatus{
+		State:        tidyStateRunning,
+		DryRun:       dryRun,
+		SafetyBuffer: safetyBuffer,
+		TimeStarted:  time.Now(),
+	}
+	b.setTidyStatus(status)
+
+	// The request context is cancelled once the response is sent
+	s := req.Storage
+	go func() {
+		defer atomic.StoreUint32(&b.tidyRunning, 0)
+		err := b.tidySecrets(context.Background(), s, status)
+
+		b.tidyStatusMutex.Lock()
+		defer b.tidyStatusMutex.Unlock()
+		status.TimeFinished = time.Now()
+		if err != nil {
+			b.Logger().Error("tidy failed", "error", err)
+			status.State = tidyStateError
+			status.Error = err.Error()
+			return
+		}
+		status.State = tidyStateFinished
+	}()
+
+	resp := &logical.Response{}
+	resp.AddWarning("Tidy operation successfully started. Check tidy-status for the result.")
+	return logical.RespondWithStatusCode(resp, req, http.StatusAccepted)
+}
+
+func (b *kubeBackend) pathTidyStatusRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.tidyStatusMutex.Lock()
+	defer b.tidyStatusMutex.Unlock()
+	status := b.tidyStatus
+	if status == nil {
+		status = &tidyStatus{State: tidyStateInactive}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"state":           status.State,
+			"dry-run":         status.DryRun,
+			"safety-buffer":   int64(status.SafetyBuffer / time.Second),
+			"time-started":    formatTime(status.TimeStarted),
+			"time-finished":   formatTime(status.TimeFinished),
+			"secrets-checked": status.SecretsChecked,
+			"orphans":         append([]string{}, status.Orphans...),
+			"orphans-deleted": status.OrphansDeleted,
+			"stale-leases":    append([]string{}, status.StaleLeases...),
+			"error":           status.Error,
+		},
+	}, nil
+}
+
+func (b *kubeBackend) setTidyStatus(status *tidyStatus) {
+	b.tidyStatusMutex.Lock()
+	defer b.tidyStatusMutex.Unlock()
+	b.tidyStatus = status
+}
+
+// tidySecrets lists Secrets created by the mount in every cluster and reports (or deletes) the ones no lease record
+// refers to. Records older than the mount's max lease TTL belong to leases Vault lost, they are reported (or deleted)
+// as stale and protect no Secret.
+func (b *kubeBackend) tidySecrets(ctx context.Context, s logical.Storage, status *tidyStatus) error {
+	mountID, err := b.getMountID(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	records, err := listLeaseRecords(ctx, s)
+	if err != nil {
+		return err
+	}
+	clusterSet := map[string]bool{"": true}
+	known := map[secretRef]bool{}
+	var stale []*leaseRecord
+	maxAge := b.System().MaxLeaseTTL() + status.SafetyBuffer
+	for _, record := range records {
+		for _, ref := range record.Secrets {
+			clusterSet[ref.Cluster] = true
+		}
+		if !record.IssueTime.IsZero() && time.Since(record.IssueTime) > maxAge {
+			stale = append(stale, record)
+			continue
+		}
+		for _, ref := range record.Secrets {
+			known[ref] = true
+		}
+	}
+
+	clusters, err := s.List(ctx, fmt.Sprintf("%s/", clustersStoragePrefix))
+	if err != nil {
+		return err
+	}
+	for _, cluster := range clusters {
+		clusterSet[cluster] = true
+	}
+	clusterNames := make([]string, 0, len(clusterSet))
+	for cluster := range clusterSet {
+		clusterNames = append(clusterNames, cluster)
+	}
+	sort.Strings(clusterNames)
+
+	for _, cluster := range clusterNames {
+		conn, err := getConnection(ctx, s, cluster)
+		if err != nil {
+			return err
+		}
+		if conn == nil {
+			if cluster != "" {
+				b.Logger().Warn("tidy skips cluster without connection", "cluster", cluster)
+			}
+			continue
+		}
+		clientSet, err := b.clientSet(cluster, conn)
+		if err != nil {
+			return err
+		}
+
+		secrets, err := clientSet.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+			LabelSelector: fmt.Sprintf("%s=%s", labelMountID, mountID),
+		})
+		if err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("unable to list Secrets of %s: {{err}}", clusterDescription(cluster)), err)
+		}
+
+		for _, secret := range secrets.Items {
+			ref := secretRef{Cluster: cluster, Namespace: secret.Namespace, Name: secret.Name}
+			b.tidyStatusMutex.Lock()
+			status.SecretsChecked++
+			b.tidyStatusMutex.Unlock()
+			if known[ref] || time.Since(secret.CreationTimestamp.Time) < status.SafetyBuffer {
+				continue
+			}
+
+			b.Logger().Warn("found Secret without lease", "secret", ref.String(), "dry-run", status.DryRun)
+			b.tidyStatusMutex.Lock()
+			status.Orphans = append(status.Orphans, ref.String())
+			b.tidyStatusMutex.Unlock()
+			if status.DryRun {
+				continue
+			}
+
+			err := clientSet.CoreV1().Secrets(secret.Namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{})
+			if err != nil && !k8serrors.IsNotFound(err) {
+				return errwrap.Wrapf(fmt.Sprintf("unable to delete Secret '%s': {{err}}", ref), err)
+			}
+			b.tidyStatusMutex.Lock()
+			status.OrphansDeleted++
+			b.tidyStatusMutex.Unlock()
+		}
+	}
+
+	// Stale records are removed last, Secrets they refer to are deleted above
+	for _, record := range stale {
+		b.Logger().Warn("found stale lease record", "record", record.ID, "binding", record.Binding, "dry-run", status.DryRun)
+		b.tidyStatusMutex.Lock()
+		status.StaleLeases = append(status.StaleLeases, record.ID)
+		b.tidyStatusMutex.Unlock()
+		if status.DryRun {
+			continue
+		}
+		if err := s.Delete(ctx, leaseStorageKey(record.ID)); err != nil {
+			return errwrap.Wrapf(fmt.Sprintf("unable to delete lease record '%s': {{err}}", record.ID), err)
+		}
+	}
+	return nil
+}
+
+const pathTidyHelpSyn = `Find ServiceAccount token Secrets which outlived their leases`
+
+const pathTidyHelpDesc = `
+If Vault loses a lease, for example after restore from a backup or a forced revocation, the Secret created for it stays
+in the cluster with a live token. Tidy lists Secrets created by this mount in all namespaces of every cluster and
+compares them against leases recorded in plugin storage. Records older than the mount's max lease TTL (plus
+safety-buffer) belong to leases Vault doesn't know anymore, they don't protect their Secrets and are reported as
+stale-leases. Orphans and stale records are reported in tidy-status, with dry-run=false they are deleted. Tidy runs in
+background.`
+
+const pathTidyStatusHelpSyn = `Status of the last tidy operation`
+
+const pathTidyStatusHelpDesc = `
+Returns state of the last tidy operation since Vault started: number of checked Secrets, orphans found and deleted,
+stale lease records and the error if the operation failed.`
@@ -0,0 +1,126 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestSecretsAPIServer starts fake Kubernetes API server which lists secrets of all namespaces and records deleted
+// ones
+func newTestSecretsAPIServer(t *testing.T, secrets []v1.Secret) (*config, func() []string) {
+	var mutex sync.Mutex
+	var deleted []string
+	c := newTestKubeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		const prefix = "/api/v1/namespaces/"
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/secrets":
+			if !strings.HasPrefix(r.URL.Query().Get("labelSelector"), labelMountID+"=") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(&v1.SecretList{Items: secrets})
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, prefix):
+			mutex.Lock()
+			deleted = append(deleted, strings.Replace(strings.TrimPrefix(r.URL.Path, prefix), "/secrets/", "/", 1))
+			mutex.Unlock()
+			json.NewEncoder(w).Encode(&metav1.Status{Status: metav1.StatusSuccess})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return c, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, deleted...)
+	}
+}
+
+func waitForTidy(t *testing.T, b logical.Backend, s logical.Storage) *logical.Response {
+	for i := 0; i < 50; i++ {
+		resp := assertNoErrorRequest(t, b, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "tidy-status",
+			Storage:   s,
+		})
+		if resp.Data["state"] != tidyStateRunning {
+			return resp
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("tidy didn't finish")
+	return nil
+}
+
+func TestTidy(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	resp := assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "tidy-status",
+		Storage:   s,
+	})
+	assertEquals(t, resp.Data["state"], tidyStateInactive, "")
+
+	old := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	c, deleted := newTestSecretsAPIServer(t, []v1.Secret{
+		{ObjectMeta: metav1.ObjectMeta{Name: "vault-test-leased", Namespace: "test", CreationTimestamp: old}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "vault-test-orphan", Namespace: "test", CreationTimestamp: old}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "vault-test-fresh", Namespace: "test", CreationTimestamp: metav1.Now()}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "vault-test-stale", Namespace: "other", CreationTimestamp: old}},
+	})
+	assertNoError(t, putConfigEntry(context.Background(), s, ConfigStorageKey, c))
+	assertNoError(t, putLeaseRecord(context.Background(), s, &leaseRecord{
+		ID:      "1",
+		Binding: "test",
+		Secrets: []secretRef{{Namespace: "test", Name: "vault-test-leased"}},
+	}))
+	// Lease of the record is older than max lease TTL, Vault doesn't know it anymore
+	assertNoError(t, putLeaseRecord(context.Background(), s, &leaseRecord{
+		ID:        "2",
+		Binding:   "test",
+		IssueTime: time.Now().Add(-(maxLeaseTTLHr + 2) * time.Hour),
+		Secrets:   []secretRef{{Namespace: "other", Name: "vault-test-stale"}},
+	}))
+	b.(*kubeBackend).testMode = false
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "tidy",
+		Storage:   s,
+	})
+	resp = waitForTidy(t, b, s)
+	assertEquals(t, resp.Data["state"], tidyStateFinished, "")
+	assertEquals(t, resp.Data["secrets-checked"], 4, "")
+	assertEquals(t, strings.Join(resp.Data["orphans"].([]string), ","), "test/vault-test-orphan,other/vault-test-stale", "")
+	assertEquals(t, strings.Join(resp.Data["stale-leases"].([]string), ","), "2", "")
+	assertEquals(t, len(deleted()), 0, "Dry run must not delete anything")
+	records, err := listLeaseRecords(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, len(records), 2, "Dry run must not delete lease records")
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "tidy",
+		Data: map[string]interface{}{
+			"dry-run": false,
+		},
+		Storage: s,
+	})
+	resp = waitForTidy(t, b, s)
+	assertEquals(t, resp.Data["orphans-deleted"], 2, "")
+	assertEquals(t, strings.Join(deleted(), ","), "test/vault-test-orphan,other/vault-test-stale", "")
+	records, err = listLeaseRecords(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, len(records), 1, "Stale lease record must be deleted")
+	assertEquals(t, records[0].ID, "1", "")
+}
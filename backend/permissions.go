@@ -0,0 +1,273 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// allNamespaces marks rules which apply in every namespace and to cluster scoped resources
+const allNamespaces = "*"
+
+// effectivePermissions is what a token of a binding carries in a single cluster
+type effectivePermissions struct {
+	Subjects []string
+	// Bindings are RoleBindings and ClusterRoleBindings which grant Rules, including the ones created per lease
+	Bindings []string
+	Rules    []map[string]interface{}
+}
+
+// addRules flattens rules granted in namespace by source
+func (p *effectivePermissions) addRules(namespace, source string, rules []rbacv1.PolicyRule) {
+	for _, rule := range rules {
+		p.Rules = append(p.Rules, map[string]interface{}{
+			"namespace":         namespace,
+			"source":            source,
+			"verbs":             rule.Verbs,
+			"api-groups":        rule.APIGroups,
+			"resources":         rule.Resources,
+			"resource-names":    rule.ResourceNames,
+			"non-resource-urls": rule.NonResourceURLs,
+		})
+	}
+}
+
+// tokenSubjects returns RBAC subjects Kubernetes authenticates a token of sa as. ServiceAccount of a dynamic binding
+// is created per lease, so only its groups are known in advance. Grant bindings issue no token.
+func tokenSubjects(sa *ServiceAccount) []rbacv1.Subject {
+	authenticated := rbacv1.Subject{Kind: rbacv1.GroupKind, Name: "system:authenticated"}
+	switch {
+	case sa.bindingType() == bindingTypeGrant:
+		return nil
+	case sa.tokenType() == tokenTypeCertificate:
+		subjects := []rbacv1.Subject{{Kind: rbacv1.UserKind, Name: sa.UserName}}
+		for _, group := range sa.Groups {
+			subjects = append(subjects, rbacv1.Subject{Kind: rbacv1.GroupKind, Name: group})
+		}
+		return append(subjects, authenticated)
+	}
+	subjects := []rbacv1.Subject{
+		{Kind: rbacv1.GroupKind, Name: "system:serviceaccounts"},
+		{Kind: rbacv1.GroupKind, Name: fmt.Sprintf("system:serviceaccounts:%s", sa.Namespace)},
+		authenticated,
+	}
+	if sa.bindingType() == bindingTypeExisting {
+		subjects = append([]rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: sa.ServiceAccountName, Namespace: sa.Namespace}}, subjects...)
+	}
+	return subjects
+}
+
+func subjectString(s rbacv1.Subject) string {
+	if s.Kind == rbacv1.ServiceAccountKind {
+		return fmt.Sprintf("%s %s/%s", s.Kind, s.Namespace, s.Name)
+	}
+	return fmt.Sprintf("%s %s", s.Kind, s.Name)
+}
+
+// bindsSubject reports whether any of subjects of a binding in namespace bindingNamespace (empty for
+// ClusterRoleBindings) is one of subjects
+func bindsSubject(bindingSubjects []rbacv1.Subject, bindingNamespace string, subjects []rbacv1.Subject) bool {
+	for _, bs := range bindingSubjects {
+		namespace := bs.Namespace
+		if bs.Kind == rbacv1.ServiceAccountKind && namespace == "" {
+			namespace = bindingNamespace
+		}
+		for _, s := range subjects {
+			if bs.Kind == s.Kind && bs.Name == s.Name && (bs.Kind != rbacv1.ServiceAccountKind || namespace == s.Namespace) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// roleRules returns rules of the Role or ClusterRole ref points to, nil if it doesn't exist. Roles are looked up in
+// namespace.
+func roleRules(ctx context.Context, clientSet *kubernetes.Clientset, namespace string, ref rbacv1.RoleRef) ([]rbacv1.PolicyRule, bool, error) {
+	var rules []rbacv1.PolicyRule
+	var err error
+	if ref.Kind == "Role" {
+		var role *rbacv1.Role
+		if role, err = clientSet.RbacV1().Roles(namespace).Get(ctx, ref.Name, metav1.GetOptions{}); err == nil {
+			rules = role.Rules
+		}
+	} else {
+		var role *rbacv1.ClusterRole
+		if role, err = clientSet.RbacV1().ClusterRoles().Get(ctx, ref.Name, metav1.GetOptions{}); err == nil {
+			rules = role.Rules
+		}
+	}
+	if k8serrors.IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errwrap.Wrapf(fmt.Sprintf("Unable to get %s '%s', {{err}}", ref.Kind, ref.Name), err)
+	}
+	return rules, true, nil
+}
+
+// getEffectivePermissions evaluates RBAC of the cluster for a token of sa in its namespace: RoleBindings of the
+// namespace and ClusterRoleBindings which bind any of its subjects, and the Role or ClusterRole dynamic and grant
+// bindings bind per lease. Aggregated ClusterRoles are read with rules already aggregated by Kubernetes.
+func getEffectivePermissions(ctx context.Context, clientSet *kubernetes.Clientset, sa *ServiceAccount) (*effectivePermissions, error) {
+	p := &effectivePermissions{}
+	subjects := tokenSubjects(sa)
+	for _, s := range subjects {
+		p.Subjects = append(p.Subjects, subjectString(s))
+	}
+
+	if sa.bindingType() != bindingTypeExisting {
+		leaseNamespace := sa.Namespace
+		if sa.ClusterScoped {
+			leaseNamespace = allNamespaces
+		}
+		if len(sa.Rules) > 0 {
+			p.Bindings = append(p.Bindings, "Role with rules of the binding, created per lease")
+			p.addRules(leaseNamespace, "Role created per lease", sa.Rules)
+		} else {
+			rules, found, err := roleRules(ctx, clientSet, "", rbacv1.RoleRef{Kind: "ClusterRole", Name: sa.ClusterRole})
+			if err != nil {
+				return nil, err
+			}
+			source := fmt.Sprintf("ClusterRole %s", sa.ClusterRole)
+			if !found {
+				source += " (not found)"
+			}
+			p.Bindings = append(p.Bindings, fmt.Sprintf("%s, bound per lease", source))
+			p.addRules(leaseNamespace, source, rules)
+		}
+	}
+	if len(subjects) == 0 {
+		return p, nil
+	}
+
+	clusterRoleBindings, err := clientSet.RbacV1().ClusterRoleBindings().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errwrap.Wrapf("Unable to list ClusterRoleBindings, {{err}}", err)
+	}
+	for _, binding := range clusterRoleBindings.Items {
+		if !bindsSubject(binding.Subjects, "", subjects) {
+			continue
+		}
+		rules, found, err := roleRules(ctx, clientSet, "", binding.RoleRef)
+		if err != nil {
+			return nil, err
+		}
+		source := fmt.Sprintf("ClusterRoleBinding %s -> %s %s", binding.Name, binding.RoleRef.Kind, binding.RoleRef.Name)
+		if !found {
+			source += " (not found)"
+		}
+		p.Bindings = append(p.Bindings, source)
+		p.addRules(allNamespaces, source, rules)
+	}
+
+	roleBindings, err := clientSet.RbacV1().RoleBindings(sa.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Unable to list RoleBindings in namespace '%s', {{err}}", sa.Namespace), err)
+	}
+	for _, binding := range roleBindings.Items {
+		if !bindsSubject(binding.Subjects, sa.Namespace, subjects) {
+			continue
+		}
+		rules, found, err := roleRules(ctx, clientSet, sa.Namespace, binding.RoleRef)
+		if err != nil {
+			return nil, err
+		}
+		source := fmt.Sprintf("RoleBinding %s/%s -> %s %s", sa.Namespace, binding.Name, binding.RoleRef.Kind, binding.RoleRef.Name)
+		if !found {
+			source += " (not found)"
+		}
+		p.Bindings = append(p.Bindings, source)
+		p.addRules(sa.Namespace, source, rules)
+	}
+	return p, nil
+}
+
+func pathServiceAccountPermissions(b *kubeBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: fmt.Sprintf("%s/%s/permissions$", saStoragePrefix, framework.GenericNameRegex("name")),
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Required. Name of the Vault object",
+			},
+			"namespace": {
+				Type: framework.TypeString,
+				Description: `Optional. Namespace to evaluate permissions in for bindings which let creds requests pick
+namespace, the binding's namespace by default`,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathServiceAccountPermissionsRead,
+		},
+		HelpSynopsis:    pathServiceAccountPermissionsHelpSyn,
+		HelpDescription: pathServiceAccountPermissionsHelpDesc,
+	}
+}
+
+func (b *kubeBackend) pathServiceAccountPermissionsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	sa, err := b.readServiceAccount(ctx, name, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if sa == nil {
+		return nil, nil
+	}
+	if sa.usesIdentityTemplates() {
+		return logical.ErrorResponse(fmt.Sprintf("ServiceAccount '%s' uses identity templates, its permissions depend on the requesting entity", name)), nil
+	}
+	namespace, errResp := resolveNamespace(sa, d.Get("namespace").(string))
+	if errResp != nil {
+		return errResp, nil
+	}
+	target := *sa
+	target.Namespace = namespace
+
+	targets, errResp, err := fanOutTargets(ctx, req.Storage, &target)
+	if err != nil || errResp != nil {
+		return errResp, err
+	}
+
+	permissions := make([]map[string]interface{}, 0, len(targets))
+	for _, t := range targets {
+		p := &effectivePermissions{}
+		if !b.testMode {
+			clientSet, err := b.clientSet(t.sa.Cluster, t.conn)
+			if err != nil {
+				return nil, err
+			}
+			if p, err = getEffectivePermissions(ctx, clientSet, t.sa); err != nil {
+				return nil, errwrap.Wrapf(fmt.Sprintf("%s: {{err}}", clusterDescription(t.sa.Cluster)), err)
+			}
+		}
+		permissions = append(permissions, map[string]interface{}{
+			"cluster":   t.sa.Cluster,
+			"namespace": namespace,
+			"subjects":  p.Subjects,
+			"bindings":  p.Bindings,
+			"rules":     p.Rules,
+		})
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"binding-type": sa.bindingType(),
+			"permissions":  permissions,
+		},
+	}, nil
+}
+
+const pathServiceAccountPermissionsHelpSyn = `Kubernetes permissions a token of the binding carries.`
+const pathServiceAccountPermissionsHelpDesc = `
+Evaluates RBAC in every cluster the binding issues tokens in and returns flattened rules with the binding each rule
+comes from. Namespace '*' marks rules of ClusterRoleBindings, which apply in all namespaces and to cluster scoped
+resources. For 'dynamic' and 'grant' binding-types the Role or ClusterRole bound per lease is included. Group bindings
+are matched for the groups Kubernetes adds to ServiceAccount tokens and client certificates. Bindings with identity
+templates can't be evaluated, their subjects depend on the requesting entity.`
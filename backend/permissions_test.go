@@ -0,0 +1,125 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestRBACAPIServer serves RBAC of a cluster where ServiceAccount test/deploy-bot may edit deployments in namespace
+// test and all ServiceAccounts may view everything
+func newTestRBACAPIServer(t *testing.T) *config {
+	objects := map[string]interface{}{
+		"/apis/rbac.authorization.k8s.io/v1/clusterrolebindings": &rbacv1.ClusterRoleBindingList{Items: []rbacv1.ClusterRoleBinding{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "serviceaccounts-view"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "system:serviceaccounts"}},
+				RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "view"},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "admins"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "admins"}},
+				RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "cluster-admin"},
+			},
+		}},
+		"/apis/rbac.authorization.k8s.io/v1/namespaces/test/rolebindings": &rbacv1.RoleBindingList{Items: []rbacv1.RoleBinding{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "deploy-bot", Namespace: "test"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "deploy-bot"}},
+				RoleRef:    rbacv1.RoleRef{Kind: "Role", Name: "deployer"},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "test"},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "deploy-bot", Namespace: "other"}},
+				RoleRef:    rbacv1.RoleRef{Kind: "ClusterRole", Name: "cluster-admin"},
+			},
+		}},
+		"/apis/rbac.authorization.k8s.io/v1/namespaces/test/roles/deployer": &rbacv1.Role{
+			Rules: []rbacv1.PolicyRule{{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, Verbs: []string{"get", "update"}}},
+		},
+		"/apis/rbac.authorization.k8s.io/v1/clusterroles/view": &rbacv1.ClusterRole{
+			Rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list"}}},
+		},
+	}
+	c := newTestKubeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		object, ok := objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(object)
+	}))
+	return c
+}
+
+func TestServiceAccountPermissions(t *testing.T) {
+	b, s := getTestBackend(t)
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "sa/deploy-bot",
+		Data: map[string]interface{}{
+			"namespace":            "test",
+			"service-account-name": "deploy-bot",
+		},
+		Storage: s,
+	})
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "sa/dynamic",
+		Data: map[string]interface{}{
+			"namespace":    "test",
+			"binding-type": "dynamic",
+			"rules":        `[{"apiGroups": [""], "resources": ["configmaps"], "verbs": ["create"]}]`,
+		},
+		Storage: s,
+	})
+	b.(*kubeBackend).testMode = false
+	assertNoError(t, putConfigEntry(context.Background(), s, ConfigStorageKey, newTestRBACAPIServer(t)))
+
+	read := func(name string) map[string]interface{} {
+		resp := assertNoErrorRequest(t, b, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "sa/" + name + "/permissions",
+			Storage:   s,
+		})
+		permissions := resp.Data["permissions"].([]map[string]interface{})
+		assertEquals(t, len(permissions), 1, "Single cluster binding expected")
+		return permissions[0]
+	}
+
+	p := read("deploy-bot")
+	assertEquals(t, p["subjects"].([]string)[0], "ServiceAccount test/deploy-bot", "")
+	bindings := p["bindings"].([]string)
+	assertEquals(t, len(bindings), 2, "Bindings of other subjects must be skipped")
+	assertEquals(t, bindings[0], "ClusterRoleBinding serviceaccounts-view -> ClusterRole view", "")
+	assertEquals(t, bindings[1], "RoleBinding test/deploy-bot -> Role deployer", "")
+	rules := p["rules"].([]map[string]interface{})
+	assertEquals(t, len(rules), 2, "")
+	assertEquals(t, rules[0]["namespace"], allNamespaces, "")
+	assertEquals(t, rules[1]["namespace"], "test", "")
+	assertEquals(t, rules[1]["resources"].([]string)[0], "deployments", "")
+
+	p = read("dynamic")
+	rules = p["rules"].([]map[string]interface{})
+	assertEquals(t, len(rules), 2, "Rules of the binding and of its groups expected")
+	assertEquals(t, rules[0]["source"], "Role created per lease", "")
+	assertEquals(t, rules[0]["resources"].([]string)[0], "configmaps", "")
+	assertEquals(t, rules[1]["source"], "ClusterRoleBinding serviceaccounts-view -> ClusterRole view", "")
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "sa/deploy-bot/permissions",
+		Data:      map[string]interface{}{"namespace": "other"},
+		Storage:   s,
+	})
+	assertNoError(t, err)
+	if resp == nil || !resp.IsError() {
+		t.Errorf("Namespace the binding doesn't allow must be rejected, get %#v", resp)
+	}
+}
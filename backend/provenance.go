@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	provenancePrefix = "vault-plugin-secrets-kubernetes/"
+
+	// labelMountID marks objects created by a mount, so tidy finds objects which outlived their leases
+	labelMountID       = provenancePrefix + "mount-id"
+	labelMountAccessor = provenancePrefix + "mount-accessor"
+	labelBinding       = provenancePrefix + "binding"
+	labelManagedBy     = "app.kubernetes.io/managed-by"
+
+	annotationBinding           = provenancePrefix + "binding"
+	annotationLeaseExpiresAt    = provenancePrefix + "lease-expires-at"
+	annotationLeaseMaxExpiresAt = provenancePrefix + "lease-max-expires-at"
+	annotationRequestID         = provenancePrefix + "request-id"
+	annotationEntityID          = provenancePrefix + "entity-id"
+	annotationDisplayName       = provenancePrefix + "display-name"
+
+	// annotationMetadataPrefix prefixes keys of metadata passed with creds requests
+	annotationMetadataPrefix = provenancePrefix + "metadata-"
+)
+
+// provenance is metadata of every object created in Kubernetes for a lease, it tells cluster operators who requested
+// the object and when its lease ends
+type provenance struct {
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// newProvenance describes a lease of binding sa requested by req. Lease expiration annotations are set at issue
+// time, renewals extend the lease up to the max expiration.
+func (b *kubeBackend) newProvenance(ctx context.Context, req *logical.Request, sa *ServiceAccount, ttl, maxTTL time.Duration) (*provenance, error) {
+	mountID, err := b.getMountID(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	p := &provenance{
+		Labels: map[string]string{
+			labelManagedBy: "vault",
+			labelMountID:   mountID,
+		},
+		Annotations: map[string]string{
+			annotationBinding:           sa.Name,
+			annotationLeaseExpiresAt:    formatTime(now.Add(ttl)),
+			annotationLeaseMaxExpiresAt: formatTime(now.Add(maxTTL)),
+		},
+	}
+	// Label values are restricted, values which don't fit are only kept in annotations
+	for label, value := range map[string]string{
+		labelMountAccessor: req.MountAccessor,
+		labelBinding:       sa.Name,
+	} {
+		if value != "" && len(validation.IsValidLabelValue(value)) == 0 {
+			p.Labels[label] = value
+		}
+	}
+	for annotation, value := range map[string]string{
+		annotationRequestID:   req.ID,
+		annotationEntityID:    req.EntityID,
+		annotationDisplayName: req.DisplayName,
+	} {
+		if value != "" {
+			p.Annotations[annotation] = value
+		}
+	}
+	return p, nil
+}
+
+// objectMeta returns metadata of an object named name, annotations are added to the provenance ones. Nil provenance
+// is allowed for objects created outside of a request.
+func (p *provenance) objectMeta(name string, annotations map[string]string) metav1.ObjectMeta {
+	meta := metav1.ObjectMeta{
+		Name:        name,
+		Annotations: map[string]string{},
+	}
+	if p != nil {
+		meta.Labels = map[string]string{}
+		for k, v := range p.Labels {
+			meta.Labels[k] = v
+		}
+		for k, v := range p.Annotations {
+			meta.Annotations[k] = v
+		}
+	}
+	for k, v := range annotations {
+		meta.Annotations[k] = v
+	}
+	if len(meta.Annotations) == 0 {
+		meta.Annotations = nil
+	}
+	return meta
+}
+
+// metadataAnnotations turns metadata of a creds request into annotations. Keys are prefixed, so requests can't
+// overwrite annotations Kubernetes or the plugin rely on.
+func metadataAnnotations(metadata map[string]string) (map[string]string, *logical.Response) {
+	annotations := map[string]string{}
+	for k, v := range metadata {
+		key := annotationMetadataPrefix + k
+		if problems := validation.IsQualifiedName(key); len(problems) > 0 {
+			return nil, logical.ErrorResponse(fmt.Sprintf("metadata key '%s' is invalid: %s", k, strings.Join(problems, ", ")))
+		}
+		annotations[key] = v
+	}
+	return annotations, nil
+}
@@ -0,0 +1,63 @@
+package backend
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestProvenance(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	req := &logical.Request{
+		ID:            "request-id",
+		MountAccessor: "plugin_1a2b3c4d",
+		EntityID:      "entity-id",
+		DisplayName:   "oidc-jane@example.com",
+		Storage:       s,
+	}
+	p, err := b.(*kubeBackend).newProvenance(context.Background(), req, &ServiceAccount{Name: "deploy-bot"}, time.Minute, time.Hour)
+	assertNoError(t, err)
+
+	mountID, err := b.(*kubeBackend).getMountID(context.Background(), s)
+	assertNoError(t, err)
+
+	meta := p.objectMeta("vault-deploy-bot-abcdefgh", map[string]string{
+		"kubernetes.io/service-account.name": "deploy-bot",
+	})
+	assertEquals(t, meta.Name, "vault-deploy-bot-abcdefgh", "")
+	assertEquals(t, meta.Labels[labelManagedBy], "vault", "")
+	assertEquals(t, meta.Labels[labelMountID], mountID, "")
+	assertEquals(t, meta.Labels[labelMountAccessor], "plugin_1a2b3c4d", "")
+	assertEquals(t, meta.Labels[labelBinding], "deploy-bot", "")
+	assertEquals(t, meta.Annotations["kubernetes.io/service-account.name"], "deploy-bot", "")
+	assertEquals(t, meta.Annotations[annotationRequestID], "request-id", "")
+	assertEquals(t, meta.Annotations[annotationEntityID], "entity-id", "")
+	assertEquals(t, meta.Annotations[annotationDisplayName], "oidc-jane@example.com", "")
+	if _, err := time.Parse(time.RFC3339, meta.Annotations[annotationLeaseExpiresAt]); err != nil {
+		t.Errorf("Lease expiration must be RFC3339 timestamp, get '%s'", meta.Annotations[annotationLeaseExpiresAt])
+	}
+
+	// Binding names which are not valid label values are kept in annotations only
+	p, err = b.(*kubeBackend).newProvenance(context.Background(), req, &ServiceAccount{Name: "deploy-bot."}, time.Minute, time.Hour)
+	assertNoError(t, err)
+	meta = p.objectMeta("test", nil)
+	if _, ok := meta.Labels[labelBinding]; ok {
+		t.Errorf("Invalid label value must not be set")
+	}
+	assertEquals(t, meta.Annotations[annotationBinding], "deploy-bot.", "")
+}
+
+func TestMetadataAnnotations(t *testing.T) {
+	annotations, errResp := metadataAnnotations(map[string]string{"pipeline": "1234", "ticket.id": "OPS-42"})
+	assertEquals(t, errResp, (*logical.Response)(nil), "")
+	assertEquals(t, annotations[annotationMetadataPrefix+"pipeline"], "1234", "")
+	assertEquals(t, annotations[annotationMetadataPrefix+"ticket.id"], "OPS-42", "")
+
+	_, errResp = metadataAnnotations(map[string]string{"kubernetes.io/service-account.name": "admin"})
+	if errResp == nil || !errResp.IsError() {
+		t.Errorf("Metadata key with a prefix must be rejected")
+	}
+}
@@ -0,0 +1,267 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-multierror"
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	revocationsStoragePrefix = "revocations"
+
+	// Failed revocations are retried after revocationMinBackoff, the delay doubles with every failed attempt up to
+	// revocationMaxBackoff
+	revocationMinBackoff = time.Minute
+	revocationMaxBackoff = time.Hour
+)
+
+// pendingRevocation is a token which Vault revoked, but whose objects couldn't be deleted from the cluster. The token
+// may still be valid until they are deleted.
+type pendingRevocation struct {
+	ID      string
+	LeaseID string
+	// InternalData of the token in a single cluster, as revokeToken takes it
+	InternalData map[string]interface{}
+	Attempts     int
+	FirstFailure time.Time
+	LastAttempt  time.Time
+	NextAttempt  time.Time
+	LastError    string
+}
+
+func revocationStorageKey(id string) string {
+	return fmt.Sprintf("%s/%s", revocationsStoragePrefix, id)
+}
+
+// revocationBackoff returns delay before the next attempt after attempts failed ones
+func revocationBackoff(attempts int) time.Duration {
+	backoff := revocationMinBackoff
+	for i := 1; i < attempts && backoff < revocationMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > revocationMaxBackoff {
+		backoff = revocationMaxBackoff
+	}
+	return backoff
+}
+
+// failed records a failed attempt made at now
+func (r *pendingRevocation) failed(now time.Time, err error) {
+	r.Attempts++
+	r.LastAttempt = now
+	r.NextAttempt = now.Add(revocationBackoff(r.Attempts))
+	r.LastError = err.Error()
+}
+
+// enqueueRevocation persists failed revocation of the token described by internalData, so it's retried in the
+// background
+func (b *kubeBackend) enqueueRevocation(ctx context.Context, s logical.Storage, leaseID string, internalData map[string]interface{}, cause error) error {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	r := &pendingRevocation{
+		ID:           id,
+		LeaseID:      leaseID,
+		InternalData: internalData,
+		FirstFailure: now,
+	}
+	r.failed(now, cause)
+	if err := putPendingRevocation(ctx, s, r); err != nil {
+		return err
+	}
+	cluster, _ := internalData["cluster"].(string)
+	b.Logger().Warn("revocation failed, queued for retry", "lease", leaseID, "cluster", cluster, "error", cause)
+	return nil
+}
+
+func putPendingRevocation(ctx context.Context, s logical.Storage, r *pendingRevocation) error {
+	entry, err := logical.StorageEntryJSON(revocationStorageKey(r.ID), r)
+	if err != nil {
+		return err
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errwrap.Wrapf("unable to store pending revocation: {{err}}", err)
+	}
+	return nil
+}
+
+// listPendingRevocations returns the queue ordered by the first failure
+func listPendingRevocations(ctx context.Context, s logical.Storage) ([]*pendingRevocation, error) {
+	ids, err := s.List(ctx, fmt.Sprintf("%s/", revocationsStoragePrefix))
+	if err != nil {
+		return nil, err
+	}
+	var revocations []*pendingRevocation
+	for _, id := range ids {
+		entry, err := s.Get(ctx, revocationStorageKey(id))
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		r := &pendingRevocation{}
+		if err := entry.DecodeJSON(r); err != nil {
+			return nil, err
+		}
+		revocations = append(revocations, r)
+	}
+	sort.Slice(revocations, func(i, j int) bool {
+		return revocations[i].FirstFailure.Before(revocations[j].FirstFailure)
+	})
+	return revocations, nil
+}
+
+// retryRevocations retries queued revocations which are due at now. Revoked ones leave the queue, failed ones are
+// postponed with exponential backoff.
+func (b *kubeBackend) retryRevocations(ctx context.Context, s logical.Storage, now time.Time) error {
+	revocations, err := listPendingRevocations(ctx, s)
+	if err != nil {
+		return err
+	}
+	var result error
+	for _, r := range revocations {
+		if now.Before(r.NextAttempt) {
+			continue
+		}
+		if err := b.revokeToken(ctx, s, r.InternalData); err != nil {
+			r.failed(now, err)
+			b.Logger().Warn("retry of revocation failed", "lease", r.LeaseID, "attempts", r.Attempts, "error", err)
+			if err := putPendingRevocation(ctx, s, r); err != nil {
+				result = multierror.Append(result, err)
+			}
+			continue
+		}
+		if err := s.Delete(ctx, revocationStorageKey(r.ID)); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result
+}
+
+func pathRevocationsPending(b *kubeBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: fmt.Sprintf("%s/pending$", revocationsStoragePrefix),
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathRevocationsPendingRead,
+		},
+		HelpSynopsis:    pathRevocationsPendingHelpSyn,
+		HelpDescription: pathRevocationsPendingHelpDesc,
+	}
+}
+
+func pathRevocationsPendingEntry(b *kubeBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: fmt.Sprintf("%s/pending/%s$", revocationsStoragePrefix, framework.GenericNameRegex("id")),
+		Fields: map[string]*framework.FieldSchema{
+			"id": {
+				Type:        framework.TypeString,
+				Description: "Required. ID of the queued revocation",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.DeleteOperation: b.pathRevocationsPendingDelete,
+		},
+		HelpSynopsis:    pathRevocationsPendingEntryHelpSyn,
+		HelpDescription: pathRevocationsPendingEntryHelpDesc,
+	}
+}
+
+func (b *kubeBackend) pathRevocationsPendingRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	revocations, err := listPendingRevocations(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]map[string]interface{}, 0, len(revocations))
+	for _, r := range revocations {
+		cluster, _ := r.InternalData["cluster"].(string)
+		pending = append(pending, map[string]interface{}{
+			"id":            r.ID,
+			"lease-id":      r.LeaseID,
+			"cluster":       cluster,
+			"objects":       revocationObjects(r.InternalData),
+			"attempts":      r.Attempts,
+			"first-failure": formatTime(r.FirstFailure),
+			"last-attempt":  formatTime(r.LastAttempt),
+			"next-attempt":  formatTime(r.NextAttempt),
+			"last-error":    r.LastError,
+		})
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"pending": pending,
+		},
+	}, nil
+}
+
+func (b *kubeBackend) pathRevocationsPendingDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	id := d.Get("id").(string)
+	entry, err := req.Storage.Get(ctx, revocationStorageKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	r := &pendingRevocation{}
+	if err := entry.DecodeJSON(r); err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Delete(ctx, revocationStorageKey(id)); err != nil {
+		return nil, err
+	}
+
+	cluster, _ := r.InternalData["cluster"].(string)
+	objects := revocationObjects(r.InternalData)
+	b.Logger().Warn("queued revocation dropped", "lease", r.LeaseID, "cluster", cluster, "objects", objects)
+	resp := &logical.Response{}
+	if len(objects) > 0 {
+		resp.AddWarning(fmt.Sprintf("Objects are left in %s: %s", clusterDescription(cluster), strings.Join(objects, ", ")))
+	}
+	return resp, nil
+}
+
+// revocationObjects lists objects behind the token which still wait for deletion
+func revocationObjects(internalData map[string]interface{}) []string {
+	var objects []string
+	namespace, _ := internalData["namespace"].(string)
+	if name, _ := internalData["secret-name"].(string); name != "" {
+		objects = append(objects, fmt.Sprintf("Secret %s/%s", namespace, name))
+	}
+	if name, _ := internalData["csr-name"].(string); name != "" {
+		objects = append(objects, fmt.Sprintf("CertificateSigningRequest %s", name))
+	}
+	if d := dynamicServiceAccountFromInternalData(internalData); d != nil {
+		objects = append(objects, fmt.Sprintf("ServiceAccount %s/%s", d.Namespace, d.ServiceAccountName))
+	}
+	if g := grantFromInternalData(internalData); g != nil {
+		if g.ClusterScoped {
+			objects = append(objects, fmt.Sprintf("ClusterRoleBinding %s", g.RoleBindingName))
+		} else {
+			objects = append(objects, fmt.Sprintf("RoleBinding %s/%s", g.Namespace, g.RoleBindingName))
+		}
+	}
+	return objects
+}
+
+const pathRevocationsPendingHelpSyn = `Tokens revoked in Vault, but still alive in clusters.`
+const pathRevocationsPendingHelpDesc = `
+When objects of a revoked lease can't be deleted from the cluster, for example because API server is down, the
+revocation is queued and retried in the background with exponential backoff. The token stays valid until then.
+This path lists the queue: lease, cluster, objects to delete, attempts and the last error. Revocations which can't
+succeed anymore, for example because the cluster is gone, are dropped by deleting revocations/pending/<id>.`
+
+const pathRevocationsPendingEntryHelpSyn = `Drop a queued revocation.`
+const pathRevocationsPendingEntryHelpDesc = `
+Removes the revocation from the queue, it's not retried anymore. Objects it would delete are left in the cluster and
+returned in the warning, the token stays valid until they are deleted by hand or it expires.`
@@ -0,0 +1,211 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/logical"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestRevocationAPIServer accepts deletion of Secret test/vault-test-abc unless failing is set
+func newTestRevocationAPIServer(t *testing.T, failing *int32) *config {
+	c := newTestKubeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodDelete || r.URL.Path != "/api/v1/namespaces/test/secrets/vault-test-abc" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if atomic.LoadInt32(failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(&metav1.Status{Status: metav1.StatusFailure, Message: "API server is down"})
+			return
+		}
+		json.NewEncoder(w).Encode(&metav1.Status{Status: metav1.StatusSuccess})
+	}))
+	return c
+}
+
+func TestRevocationQueue(t *testing.T) {
+	b, s := getTestBackend(t)
+	kb := b.(*kubeBackend)
+	kb.testMode = false
+
+	var failing int32 = 1
+	assertNoError(t, putConfigEntry(context.Background(), s, ConfigStorageKey, newTestRevocationAPIServer(t, &failing)))
+
+	// Vault gets the lease revoked, the Secret stays in the queue
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret: &logical.Secret{
+			LeaseOptions: logical.LeaseOptions{IssueTime: time.Now()},
+			LeaseID:      "k8s/secrets/test/abc",
+			InternalData: map[string]interface{}{
+				"secret_type": secretTypeAccessToken,
+				"secret-name": "vault-test-abc",
+				"namespace":   "test",
+			},
+		},
+		Storage: s,
+	})
+
+	readPending := func() []map[string]interface{} {
+		resp := assertNoErrorRequest(t, b, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "revocations/pending",
+			Storage:   s,
+		})
+		return resp.Data["pending"].([]map[string]interface{})
+	}
+	pending := readPending()
+	assertEquals(t, len(pending), 1, "")
+	assertEquals(t, pending[0]["lease-id"], "k8s/secrets/test/abc", "")
+	assertEquals(t, pending[0]["attempts"], 1, "")
+	assertEquals(t, pending[0]["objects"].([]string)[0], "Secret test/vault-test-abc", "")
+
+	// Not due yet
+	now := time.Now()
+	assertNoError(t, kb.retryRevocations(context.Background(), s, now))
+	assertEquals(t, readPending()[0]["attempts"], 1, "")
+
+	now = now.Add(revocationMinBackoff)
+	assertNoError(t, kb.retryRevocations(context.Background(), s, now))
+	pending = readPending()
+	assertEquals(t, pending[0]["attempts"], 2, "")
+	assertEquals(t, pending[0]["next-attempt"], formatTime(now.Add(2*revocationMinBackoff)), "")
+
+	atomic.StoreInt32(&failing, 0)
+	assertNoError(t, kb.retryRevocations(context.Background(), s, now.Add(revocationMaxBackoff)))
+	assertEquals(t, len(readPending()), 0, "")
+}
+
+func TestRevocationBackoff(t *testing.T) {
+	assertEquals(t, revocationBackoff(1), time.Minute, "")
+	assertEquals(t, revocationBackoff(3), 4*time.Minute, "")
+	assertEquals(t, revocationBackoff(20), time.Hour, "")
+}
+
+func TestRevokeLeaseConnection(t *testing.T) {
+	b, s := getTestBackend(t)
+	kb := b.(*kubeBackend)
+	kb.testMode = false
+
+	var failing int32
+	c := newTestRevocationAPIServer(t, &failing)
+	revoke := func(internalData map[string]interface{}) []map[string]interface{} {
+		internalData["secret_type"] = secretTypeAccessToken
+		internalData["secret-name"] = "vault-test-abc"
+		internalData["namespace"] = "test"
+		assertNoErrorRequest(t, b, &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret: &logical.Secret{
+				LeaseOptions: logical.LeaseOptions{IssueTime: time.Now()},
+				InternalData: internalData,
+			},
+			Storage: s,
+		})
+		resp := assertNoErrorRequest(t, b, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "revocations/pending",
+			Storage:   s,
+		})
+		return resp.Data["pending"].([]map[string]interface{})
+	}
+
+	pending := revoke(map[string]interface{}{"version": leaseDataVersion, "cluster": "", "api-url": c.APIURL})
+	assertEquals(t, len(pending), 1, "Revocation without connection must be queued")
+	assertEquals(t, pending[0]["last-error"], "connection of config is not configured anymore, revocation will be retried once it's restored", "")
+
+	// config is repointed at another cluster
+	moved := *c
+	moved.APIURL = "https://127.0.0.1:1"
+	assertNoError(t, putConfigEntry(context.Background(), s, ConfigStorageKey, &moved))
+	pending = revoke(map[string]interface{}{"version": float64(leaseDataVersion), "cluster": "", "api-url": c.APIURL})
+	assertEquals(t, len(pending), 2, "")
+	e := "connection of config points to 'https://127.0.0.1:1' now, but the lease was issued against '" + c.APIURL +
+		"', revocation will be retried once the connection is restored"
+	assertEquals(t, pending[1]["last-error"], e, "")
+
+	// Leases issued before connections were recorded use the current connection
+	assertNoError(t, putConfigEntry(context.Background(), s, ConfigStorageKey, c))
+	pending = revoke(map[string]interface{}{"cluster": ""})
+	assertEquals(t, len(pending), 2, "")
+
+	assertNoError(t, kb.retryRevocations(context.Background(), s, time.Now().Add(revocationMaxBackoff)))
+	pending = revoke(map[string]interface{}{"cluster": ""})
+	assertEquals(t, len(pending), 0, "Queued revocations must succeed once connection is restored")
+}
+
+func TestRevocationQueueSecondary(t *testing.T) {
+	b := New()
+	b.testMode = true
+	s := &logical.InmemStorage{}
+	assertNoError(t, b.Setup(context.Background(), &logical.BackendConfig{
+		System:      &logical.StaticSystemView{ReplicationStateVal: consts.ReplicationPerformanceSecondary},
+		StorageView: s,
+	}))
+	assertNoError(t, putPendingRevocation(context.Background(), s, &pendingRevocation{
+		ID:           "abc",
+		InternalData: map[string]interface{}{"secret-name": "vault-test-abc", "namespace": "test"},
+	}))
+
+	assertNoError(t, b.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+	revocations, err := listPendingRevocations(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, len(revocations), 1, "Revocations must only be retried where storage can be written")
+}
+
+func TestRevocationQueueDrop(t *testing.T) {
+	b, s := getTestBackend(t)
+	assertNoError(t, putPendingRevocation(context.Background(), s, &pendingRevocation{
+		ID:           "abc",
+		InternalData: map[string]interface{}{"cluster": "gone", "secret-name": "vault-test-abc", "namespace": "test"},
+	}))
+
+	resp := assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      fmt.Sprintf("%s/pending/abc", revocationsStoragePrefix),
+		Storage:   s,
+	})
+	if resp == nil || len(resp.Warnings) != 1 {
+		t.Fatalf("Objects left in the cluster must be reported, get %v", resp)
+	}
+	assertEquals(t, resp.Warnings[0], "Objects are left in cluster 'gone': Secret test/vault-test-abc", "")
+	revocations, err := listPendingRevocations(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, len(revocations), 0, "Dropped revocation must leave the queue")
+
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      fmt.Sprintf("%s/pending/abc", revocationsStoragePrefix),
+		Storage:   s,
+	})
+}
+
+func TestWALRollbackError(t *testing.T) {
+	b, s := getTestBackend(t)
+	kb := b.(*kubeBackend)
+	kb.testMode = false
+
+	var failing int32 = 1
+	c := newTestRevocationAPIServer(t, &failing)
+	assertNoError(t, putConfigEntry(context.Background(), s, ConfigStorageKey, c))
+
+	entry := &walSecret{Name: "vault-test-abc", Namespace: "test", APIURL: c.APIURL}
+	err := kb.walRollback(context.Background(), &logical.Request{Storage: s}, secretWALKind, entry)
+	if err == nil {
+		t.Errorf("Failed rollback must return error, so Vault keeps the WAL entry")
+	}
+	revocations, err := listPendingRevocations(context.Background(), s)
+	assertNoError(t, err)
+	assertEquals(t, len(revocations), 0, "Rollback must not go through the revocation queue")
+
+	atomic.StoreInt32(&failing, 0)
+	assertNoError(t, kb.walRollback(context.Background(), &logical.Request{Storage: s}, secretWALKind, entry))
+}
@@ -13,8 +13,12 @@ import (
 
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	"k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 )
 
 const (
@@ -22,6 +26,12 @@ const (
 	secretPrefix          = "vault"
 	symbolsForGenerator   = "abcdefghijklmnopqrstuvwxyz0123456789"
 	secretWALKind         = "secret"
+
+	// minTokenExpiration is the shortest validity the TokenRequest API accepts
+	minTokenExpiration = 10 * time.Minute
+
+	// rollbackTimeout bounds cleanup of objects created by failed requests
+	rollbackTimeout = 30 * time.Second
 )
 
 func secretAccessTokens(b *kubeBackend) *framework.Secret {
@@ -50,18 +60,25 @@ func secretAccessTokens(b *kubeBackend) *framework.Secret {
 type walSecret struct {
 	Name      string
 	Namespace string
+	Cluster   string
+	APIURL    string
 }
 
-func (b *kubeBackend) createSecret(ctx context.Context, s logical.Storage, c *config, sa *ServiceAccount) (*logical.Response, error) {
+// issuedToken is a token created in a single cluster. WAL entries of objects created for it are committed by the
+// caller, once the whole lease is ready to be returned.
+type issuedToken struct {
+	Data         map[string]interface{}
+	InternalData map[string]interface{}
+	walIDs       []string
+}
+
+func (b *kubeBackend) createSecret(ctx context.Context, s logical.Storage, c *config, sa *ServiceAccount, p *provenance) (*issuedToken, error) {
 	name := fmt.Sprintf("%s-%s-%s", secretPrefix, sa.ServiceAccountName, generatePostfix(8))
 
 	secret := &v1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: name,
-			Annotations: map[string]string{
-				"kubernetes.io/service-account.name": sa.ServiceAccountName,
-			},
-		},
+		ObjectMeta: p.objectMeta(name, map[string]string{
+			"kubernetes.io/service-account.name": sa.ServiceAccountName,
+		}),
 		Type: "kubernetes.io/service-account-token",
 	}
 	// Write to the WAL that this user will be created. We do this before
@@ -71,6 +88,8 @@ func (b *kubeBackend) createSecret(ctx context.Context, s logical.Storage, c *co
 	walID, err := framework.PutWAL(ctx, s, secretWALKind, &walSecret{
 		Name:      name,
 		Namespace: sa.Namespace,
+		Cluster:   sa.Cluster,
+		APIURL:    c.APIURL,
 	})
 	if err != nil {
 		return nil, err
@@ -81,7 +100,11 @@ func (b *kubeBackend) createSecret(ctx context.Context, s logical.Storage, c *co
 	var resp *v1.Secret
 
 	if !b.testMode {
-		clientSet, err := getClientSet(c)
+		clientSet, err := b.clientSet(sa.Cluster, c)
+		if err != nil {
+			return nil, err
+		}
+		timeout, err := getTokenWaitTimeout(ctx, s)
 		if err != nil {
 			return nil, err
 		}
@@ -89,46 +112,168 @@ func (b *kubeBackend) createSecret(ctx context.Context, s logical.Storage, c *co
 		if err != nil {
 			return nil, errwrap.Wrapf("Unable to create secret, {{err}}", err)
 		}
-		// Do 5 tries to get secret, due to it may not generated after first try
-		for range []int{0, 1, 2, 3, 4} {
-			secretResp, err := clientSet.CoreV1().Secrets(sa.Namespace).Get(ctx, secret.Name, metav1.GetOptions{})
-			if err != nil {
-				return nil, errwrap.Wrapf("Unable to get secret, {{err}}", err)
-			}
-			if len(secretResp.Data) == 0 {
-				time.Sleep(time.Second)
-				continue
-			}
-			resp = secretResp
-			token = string(secretResp.Data["token"])
-			namespace = string(secretResp.Data["namespace"])
-			CABase64 = secretResp.Data["ca.crt"]
-			break
-		}
-		if resp == nil || len(resp.Data) == 0 {
-			return nil, errors.New("unable to get secret with 5 tries, Data was empty")
+		resp, err = waitForSecretToken(ctx, clientSet, sa.Namespace, secret.Name, timeout)
+		if err != nil {
+			b.rollbackNow(s, walID, func(ctx context.Context) error {
+				return clientSet.CoreV1().Secrets(sa.Namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{})
+			})
+			return nil, err
 		}
+		token = string(resp.Data["token"])
+		namespace = string(resp.Data["namespace"])
+		CABase64 = resp.Data["ca.crt"]
 	} else {
 		token = "test"
 		namespace = "test"
 		CABase64 = "test"
 	}
 
-	// Remove the WAL entry, we succeeded! If we fail, we don't return
-	// the secret because it'll get rolled back anyways, so we have to return
-	// an error here.
-	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
-		return nil, errwrap.Wrapf("failed to commit WAL entry: {{err}}", err)
+	return &issuedToken{
+		Data: map[string]interface{}{
+			"token":     token,
+			"namespace": namespace,
+			"CA_base64": CABase64,
+		},
+		InternalData: map[string]interface{}{
+			"secret-name": name,
+			"namespace":   sa.Namespace,
+		},
+		walIDs: []string{walID},
+	}, nil
+}
+
+// waitForSecretToken returns ServiceAccount token Secret once Kubernetes token controller populated it. The Secret is
+// watched, so it returns as soon as the token appears, but not later than timeout.
+func waitForSecretToken(ctx context.Context, clientSet *kubernetes.Clientset, namespace, name string, timeout time.Duration) (*v1.Secret, error) {
+	secrets := clientSet.CoreV1().Secrets(namespace)
+	object, err := waitForObject(ctx, timeout, name, func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+		return secrets.List(ctx, options)
+	}, secrets.Watch, func(object runtime.Object) (bool, error) {
+		secret, ok := object.(*v1.Secret)
+		return ok && len(secret.Data["token"]) > 0, nil
+	})
+	if err == errWaitTimeout {
+		return nil, fmt.Errorf("token of Secret '%s/%s' was not populated in %s, check that its ServiceAccount exists "+
+			"and the token controller is running", namespace, name, timeout)
+	}
+	if err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("Unable to get token of Secret '%s/%s', {{err}}", namespace, name), err)
+	}
+	return object.(*v1.Secret), nil
+}
+
+// createToken issues a token through the TokenRequest API. Nothing is stored in Kubernetes, the token expires on its
+// own after ttl (but not earlier than minTokenExpiration), even if the lease is never revoked. Optional boundObjectRef
+// makes the token invalid as soon as the referenced Pod or Secret is deleted.
+func (b *kubeBackend) createToken(ctx context.Context, c *config, sa *ServiceAccount, ttl time.Duration, audiences []string,
+	boundObjectRef *authenticationv1.BoundObjectReference) (*issuedToken, error) {
+	if ttl < minTokenExpiration {
+		ttl = minTokenExpiration
+	}
+	expirationSeconds := int64(ttl.Seconds())
+
+	tokenRequest := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         audiences,
+			ExpirationSeconds: &expirationSeconds,
+			BoundObjectRef:    boundObjectRef,
+		},
+	}
+
+	var token string
+	var CABase64 interface{}
+	var expiration time.Time
+
+	if !b.testMode {
+		clientSet, err := b.clientSet(sa.Cluster, c)
+		if err != nil {
+			return nil, err
+		}
+		tokenResp, err := clientSet.CoreV1().ServiceAccounts(sa.Namespace).CreateToken(ctx, sa.ServiceAccountName, tokenRequest, metav1.CreateOptions{})
+		if err != nil {
+			return nil, errwrap.Wrapf("Unable to create token, {{err}}", err)
+		}
+		token = tokenResp.Status.Token
+		expiration = tokenResp.Status.ExpirationTimestamp.Time
+		CABase64 = c.CA
+	} else {
+		token = "test"
+		CABase64 = "test"
+		expiration = time.Now().Add(ttl)
+	}
+
+	return &issuedToken{
+		Data: map[string]interface{}{
+			"token":     token,
+			"namespace": sa.Namespace,
+			"CA_base64": CABase64,
+		},
+		InternalData: map[string]interface{}{
+			"token-type":           tokenTypeTokenRequest,
+			"namespace":            sa.Namespace,
+			"service-account-name": sa.ServiceAccountName,
+			"expiration":           expiration.Unix(),
+		},
+	}, nil
+}
+
+// issueToken creates a token for the binding sa according to its token type. For dynamic bindings ServiceAccount with
+// its Role and RoleBinding is created first, the token then covers all of them. WAL entries of all created objects
+// are returned uncommitted.
+func (b *kubeBackend) issueToken(ctx context.Context, s logical.Storage, c *config, sa *ServiceAccount, ttl time.Duration, audiences []string,
+	boundObjectRef *authenticationv1.BoundObjectReference, p *provenance) (*issuedToken, error) {
+	if sa.bindingType() == bindingTypeGrant {
+		token, err := b.createGrant(ctx, s, c, sa, p)
+		if err != nil {
+			return nil, err
+		}
+		setConnectionRef(token.InternalData, sa.Cluster, c.APIURL)
+		return token, nil
 	}
 
-	return b.Secret(secretTypeAccessToken).Response(map[string]interface{}{
-		"token":     token,
-		"namespace": namespace,
-		"CA_base64": CABase64,
-	}, map[string]interface{}{
-		"secret-name": name,
-		"namespace":   sa.Namespace,
-	}), nil
+	var dynamic *dynamicServiceAccount
+	var dynamicWALID string
+	if sa.bindingType() == bindingTypeDynamic {
+		var err error
+		dynamic, dynamicWALID, err = b.createDynamicServiceAccount(ctx, s, c, sa, p)
+		if err != nil {
+			return nil, err
+		}
+		target := *sa
+		target.ServiceAccountName = dynamic.ServiceAccountName
+		sa = &target
+	}
+
+	var token *issuedToken
+	var err error
+	switch sa.tokenType() {
+	case tokenTypeTokenRequest:
+		token, err = b.createToken(ctx, c, sa, ttl, audiences, boundObjectRef)
+	case tokenTypeCertificate:
+		token, err = b.createCertificate(ctx, s, c, sa, ttl, p)
+	default:
+		token, err = b.createSecret(ctx, s, c, sa, p)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	setConnectionRef(token.InternalData, sa.Cluster, c.APIURL)
+	if dynamic != nil {
+		dynamic.toInternalData(token.InternalData)
+		token.walIDs = append(token.walIDs, dynamicWALID)
+	}
+	return token, nil
+}
+
+// commitWALs removes WAL entries of objects, which are now covered by a lease
+func commitWALs(ctx context.Context, s logical.Storage, walIDs []string) error {
+	for _, walID := range walIDs {
+		if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+			return errwrap.Wrapf("failed to commit WAL entry: {{err}}", err)
+		}
+	}
+	return nil
 }
 
 func init() {
@@ -143,57 +288,212 @@ func generatePostfix(n int) string {
 	return string(b)
 }
 
+// secretAccessTokenRenew extends the lease by the requested increment (or the binding's TTL), but never beyond its max
+// TTL counted from issue time. Tokens which expire in Kubernetes on their own can't be extended past their expiration.
 func (b *kubeBackend) secretAccessTokenRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	c, err := getConfig(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
+	if c == nil {
+		c = defaultConfig()
+	}
 
-	resp := &logical.Response{Secret: req.Secret}
-	resp.Secret.TTL = c.TTL
-	resp.Secret.MaxTTL = c.MaxTTL
+	ttl, maxTTL := c.TTL, c.MaxTTL
+	// Leases issued before bindings had their own TTLs don't know the binding, config TTLs apply to them
+	if name, _ := req.Secret.InternalData["binding-name"].(string); name != "" {
+		sa, err := getServiceAccount(ctx, name, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if sa != nil {
+			ttl, maxTTL = sa.leaseTTLs(c)
+		}
+	}
+
+	newTTL, warnings, err := framework.CalculateTTL(b.System(), req.Secret.Increment, ttl, 0, maxTTL, 0, req.Secret.IssueTime)
+	if err != nil {
+		return nil, err
+	}
+
+	if expiration := leaseExpiration(req.Secret.InternalData); !expiration.IsZero() {
+		remaining := time.Until(expiration).Truncate(time.Second)
+		if remaining <= 0 {
+			return nil, errors.New("credential has already expired in Kubernetes, it can't be renewed")
+		}
+		if newTTL > remaining {
+			warnings = append(warnings, fmt.Sprintf("TTL is capped to %s, the credential expires in Kubernetes at %s",
+				remaining, expiration.UTC().Format(time.RFC3339)))
+			newTTL = remaining
+		}
+	}
+
+	resp := &logical.Response{Secret: req.Secret, Warnings: warnings}
+	resp.Secret.TTL = newTTL
+	resp.Secret.MaxTTL = maxTTL
 	return resp, nil
 }
 
+// leaseExpiration returns the earliest time a credential of the lease expires in Kubernetes on its own, zero if none
+// of them expires
+func leaseExpiration(internalData map[string]interface{}) time.Time {
+	var result time.Time
+	tokens := fanOutTokens(internalData)
+	if tokens == nil {
+		tokens = []map[string]interface{}{internalData}
+	}
+	for _, token := range tokens {
+		unix, ok := internalDataInt64(token["expiration"])
+		if !ok {
+			continue
+		}
+		expiration := time.Unix(unix, 0)
+		if result.IsZero() || expiration.Before(result) {
+			result = expiration
+		}
+	}
+	return result
+}
+
 func (b *kubeBackend) secretAccessTokenRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	c, err := getConfig(ctx, req.Storage)
+	tokens := fanOutTokens(req.Secret.InternalData)
+	if tokens == nil {
+		tokens = []map[string]interface{}{req.Secret.InternalData}
+	}
+	// One failed cluster doesn't stop revocation in others. Failures are queued and retried in the background, Vault
+	// would otherwise retry the whole lease with its own backoff.
+	for _, token := range tokens {
+		if err := b.revokeToken(ctx, req.Storage, token); err != nil {
+			if err := b.enqueueRevocation(ctx, req.Storage, req.Secret.LeaseID, token, err); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if recordID, _ := req.Secret.InternalData["lease-record"].(string); recordID != "" {
+		if err := req.Storage.Delete(ctx, leaseStorageKey(recordID)); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// revokeToken deletes everything created in Kubernetes for a token issued in a single cluster. Objects which are
+// already gone are skipped, so revocation can be retried safely.
+func (b *kubeBackend) revokeToken(ctx context.Context, s logical.Storage, internalData map[string]interface{}) error {
+	// Tokens issued through the TokenRequest API for existing ServiceAccount have no object behind them, they expire
+	// on their own
+	name, _ := internalData["secret-name"].(string)
+	csrName, _ := internalData["csr-name"].(string)
+	dynamic := dynamicServiceAccountFromInternalData(internalData)
+	g := grantFromInternalData(internalData)
+	if name == "" && csrName == "" && dynamic == nil && g == nil {
+		return nil
+	}
+
+	if b.testMode {
+		return nil
+	}
+
+	// Leases are bound to the cluster they were issued in, the binding might point to another cluster already
+	cluster, c, err := leaseConnection(ctx, s, internalData)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	clientSet, err := getClientSet(c)
+	clientSet, err := b.clientSet(cluster, c)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	namespace := req.Secret.InternalData["namespace"].(string)
-	name := req.Secret.InternalData["secret-name"].(string)
+	if name != "" {
+		namespace := internalData["namespace"].(string)
 
-	err = clientSet.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		err = clientSet.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
 
-	if err != nil {
-		return nil, err
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
 	}
-	return nil, nil
+
+	if csrName != "" {
+		// Kubernetes can't revoke certificates, they stay valid until they expire
+		err = clientSet.CertificatesV1().CertificateSigningRequests().Delete(ctx, csrName, metav1.DeleteOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	if dynamic != nil {
+		if err := deleteDynamicServiceAccount(ctx, clientSet, dynamic); err != nil {
+			return err
+		}
+	}
+
+	if g != nil {
+		if err := deleteGrant(ctx, clientSet, g); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (b *kubeBackend) walRollback(ctx context.Context, r *logical.Request, kind string, data interface{}) error {
-	var entry walSecret
-	if err := mapstructure.Decode(data, &entry); err != nil {
-		return err
+// rollbackNow deletes an object of a failed request right away instead of waiting for the periodic WAL rollback. The
+// WAL entry walID is kept if the object can't be deleted, so the periodic rollback retries.
+func (b *kubeBackend) rollbackNow(s logical.Storage, walID string, deleteObject func(ctx context.Context) error) {
+	// The request context may be already cancelled, cleanup must happen anyway
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	if err := deleteObject(ctx); err != nil && !k8serrors.IsNotFound(err) {
+		b.Logger().Warn("unable to roll back object of failed request, left for WAL rollback", "error", err)
+		return
+	}
+	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+		b.Logger().Warn("unable to remove WAL entry of rolled back object", "error", err)
 	}
+}
 
+// walRollback deletes an object left behind by a failed request. Errors are returned, so Vault keeps the WAL entry
+// and retries until the object is gone.
+func (b *kubeBackend) walRollback(ctx context.Context, r *logical.Request, kind string, data interface{}) error {
+	internalData := map[string]interface{}{}
 	switch kind {
 	case secretWALKind:
-		r.Secret = &logical.Secret{
-			InternalData: map[string]interface{}{
-				"secret-name": entry.Name,
-				"namespace":   entry.Namespace,
-			},
+		var entry walSecret
+		if err := mapstructure.Decode(data, &entry); err != nil {
+			return err
 		}
-		_, err := b.secretAccessTokenRevoke(ctx, r, nil)
-		return err
+		// Root token rotation stores the new token before it removes the WAL entry of its Secret
+		inUse, err := isRootTokenSecret(ctx, r.Storage, entry.Cluster, entry.Namespace, entry.Name)
+		if err != nil || inUse {
+			return err
+		}
+		internalData["secret-name"] = entry.Name
+		internalData["namespace"] = entry.Namespace
+		setConnectionRef(internalData, entry.Cluster, entry.APIURL)
+	case certificateSigningRequestWALKind:
+		var entry walCertificateSigningRequest
+		if err := mapstructure.Decode(data, &entry); err != nil {
+			return err
+		}
+		internalData["csr-name"] = entry.Name
+		setConnectionRef(internalData, entry.Cluster, entry.APIURL)
+	case grantWALKind:
+		var entry grant
+		if err := mapstructure.Decode(data, &entry); err != nil {
+			return err
+		}
+		setConnectionRef(internalData, entry.Cluster, entry.APIURL)
+		entry.toInternalData(internalData)
+	case dynamicServiceAccountWALKind:
+		var entry dynamicServiceAccount
+		if err := mapstructure.Decode(data, &entry); err != nil {
+			return err
+		}
+		setConnectionRef(internalData, entry.Cluster, entry.APIURL)
+		entry.toInternalData(internalData)
 	default:
 		return fmt.Errorf("unknown kind to rollback %s", kind)
 	}
+	return b.revokeToken(ctx, r.Storage, internalData)
 }
@@ -0,0 +1,324 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/logical"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// permission is a single action the plugin performs in Kubernetes
+type permission struct {
+	Verb        string
+	Group       string
+	Resource    string
+	Subresource string
+	// Name restricts the permission to a single object
+	Name string
+}
+
+func (p permission) String() string {
+	resource := p.Resource
+	if p.Subresource != "" {
+		resource += "/" + p.Subresource
+	}
+	if p.Group != "" {
+		resource += "." + p.Group
+	}
+	if p.Name != "" {
+		resource += " " + p.Name
+	}
+	return p.Verb + " " + resource
+}
+
+// secretPermissions are needed to issue legacy Secret tokens and to rotate the plugin's own token
+var secretPermissions = []permission{
+	{Verb: "create", Resource: "secrets"},
+	{Verb: "list", Resource: "secrets"},
+	{Verb: "watch", Resource: "secrets"},
+	{Verb: "delete", Resource: "secrets"},
+}
+
+// requiredPermissions returns everything the plugin needs to issue tokens for sa
+func requiredPermissions(sa *ServiceAccount) []permission {
+	var permissions []permission
+	if sa.bindingType() == bindingTypeGrant {
+		bindingResource := "rolebindings"
+		if sa.ClusterScoped {
+			bindingResource = "clusterrolebindings"
+		}
+		permissions = append(permissions,
+			permission{Verb: "create", Group: "rbac.authorization.k8s.io", Resource: bindingResource},
+			permission{Verb: "delete", Group: "rbac.authorization.k8s.io", Resource: bindingResource},
+			permission{Verb: "bind", Group: "rbac.authorization.k8s.io", Resource: "clusterroles", Name: sa.ClusterRole},
+		)
+		return append(permissions, namespacePermissions(sa)...)
+	}
+
+	switch sa.tokenType() {
+	case tokenTypeTokenRequest:
+		permissions = append(permissions, permission{Verb: "create", Resource: "serviceaccounts", Subresource: "token"})
+	case tokenTypeCertificate:
+		permissions = append(permissions,
+			permission{Verb: "create", Group: "certificates.k8s.io", Resource: "certificatesigningrequests"},
+			permission{Verb: "list", Group: "certificates.k8s.io", Resource: "certificatesigningrequests"},
+			permission{Verb: "watch", Group: "certificates.k8s.io", Resource: "certificatesigningrequests"},
+			permission{Verb: "delete", Group: "certificates.k8s.io", Resource: "certificatesigningrequests"},
+			permission{Verb: "update", Group: "certificates.k8s.io", Resource: "certificatesigningrequests", Subresource: "approval"},
+			permission{Verb: "approve", Group: "certificates.k8s.io", Resource: "signers", Name: clientCertificateSignerName},
+		)
+	default:
+		permissions = append(permissions, secretPermissions...)
+	}
+
+	if sa.bindingType() == bindingTypeDynamic {
+		permissions = append(permissions,
+			permission{Verb: "create", Resource: "serviceaccounts"},
+			permission{Verb: "delete", Resource: "serviceaccounts"},
+		)
+		roleResource, bindingResource := "roles", "rolebindings"
+		if sa.ClusterScoped {
+			roleResource, bindingResource = "clusterroles", "clusterrolebindings"
+		}
+		if sa.ClusterRole == "" {
+			permissions = append(permissions,
+				permission{Verb: "create", Group: "rbac.authorization.k8s.io", Resource: roleResource},
+				permission{Verb: "delete", Group: "rbac.authorization.k8s.io", Resource: roleResource},
+			)
+		}
+		permissions = append(permissions,
+			permission{Verb: "create", Group: "rbac.authorization.k8s.io", Resource: bindingResource},
+			permission{Verb: "delete", Group: "rbac.authorization.k8s.io", Resource: bindingResource},
+		)
+	}
+	return append(permissions, namespacePermissions(sa)...)
+}
+
+// namespacePermissions are needed to check labels of namespaces picked by creds requests
+func namespacePermissions(sa *ServiceAccount) []permission {
+	if sa.NamespaceSelector == "" {
+		return nil
+	}
+	return []permission{{Verb: "get", Resource: "namespaces"}}
+}
+
+// mountPermissions merges permissions needed by bindings, Secret permissions are always required
+func mountPermissions(bindings []*ServiceAccount) []permission {
+	seen := map[permission]bool{}
+	var permissions []permission
+	add := func(ps []permission) {
+		for _, p := range ps {
+			if !seen[p] {
+				seen[p] = true
+				permissions = append(permissions, p)
+			}
+		}
+	}
+	add(secretPermissions)
+	for _, sa := range bindings {
+		add(requiredPermissions(sa))
+	}
+	return permissions
+}
+
+// checkPermissions runs SelfSubjectAccessReview for every permission in namespace (empty namespace means all
+// namespaces) and returns denied ones
+func checkPermissions(ctx context.Context, clientSet *kubernetes.Clientset, namespace string, permissions []permission) ([]string, error) {
+	var denied []string
+	for _, p := range permissions {
+		review, err := clientSet.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   namespace,
+					Verb:        p.Verb,
+					Group:       p.Group,
+					Resource:    p.Resource,
+					Subresource: p.Subresource,
+					Name:        p.Name,
+				},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("Unable to check permission to %s, {{err}}", p), err)
+		}
+		if !review.Status.Allowed {
+			denied = append(denied, fmt.Sprintf("not allowed to %s", p))
+		}
+	}
+	return denied, nil
+}
+
+// verifyConnection checks that API server behind c is reachable, accepts the token and allows all permissions in all
+// namespaces. Returned problems are meant for the user.
+func verifyConnection(ctx context.Context, c *config, permissions []permission) []string {
+	clientSet, err := getClientSet(c)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	if _, err := clientSet.Discovery().ServerVersion(); err != nil {
+		return []string{fmt.Sprintf("Unable to reach Kubernetes API server: %s", err)}
+	}
+
+	denied, err := checkPermissions(ctx, clientSet, "", permissions)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	return denied
+}
+
+// verifyClusterConnection verifies connection c of cluster for all bindings which use it. Problems are returned as an
+// error response.
+func (b *kubeBackend) verifyClusterConnection(ctx context.Context, s logical.Storage, cluster string, c *config) (*logical.Response, error) {
+	bindings, err := listServiceAccounts(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if problems := verifyConnection(ctx, c, mountPermissions(bindingsForCluster(bindings, cluster, c.Labels))); len(problems) > 0 {
+		return verificationErrorResponse(problems), nil
+	}
+	return nil, nil
+}
+
+// verificationErrorResponse lists all problems in the error message, they are also available in data for callers
+// which get the full response
+func verificationErrorResponse(problems []string) *logical.Response {
+	resp := logical.ErrorResponse(fmt.Sprintf("Kubernetes connection check failed: %s", strings.Join(problems, "; ")))
+	resp.Data["problems"] = problems
+	return resp
+}
+
+// clusterDescription names cluster in messages, empty cluster means the default connection from config
+func clusterDescription(cluster string) string {
+	if cluster == "" {
+		return "the default cluster"
+	}
+	return fmt.Sprintf("cluster '%s'", cluster)
+}
+
+// verifyBinding checks binding sa in every cluster it issues tokens in: namespace and ServiceAccount must exist and the
+// plugin should have all permissions it needs there. Missing objects fail the write, other problems are returned as
+// warnings, so a binding can still be stored while the cluster is unreachable. With createIfMissing a missing
+// ServiceAccount is created instead, targets it was created in are returned, so the caller can delete them if the
+// binding isn't stored. Bindings whose namespace is picked or rendered per request are checked when tokens are issued.
+func (b *kubeBackend) verifyBinding(ctx context.Context, s logical.Storage, sa *ServiceAccount, createIfMissing bool) (warnings []string, created []fanOutTarget, errResp *logical.Response, err error) {
+	if b.testMode || sa.Namespace == "" || isIdentityTemplate(sa.Namespace) {
+		return nil, nil, nil, nil
+	}
+	// ServiceAccounts created in other clusters must not outlive a failed check
+	defer func() {
+		if errResp != nil || err != nil {
+			errResp, err = b.failBindingWrite(sa, created, errResp, err)
+			created = nil
+		}
+	}()
+
+	targets, targetsErrResp, err := fanOutTargets(ctx, s, sa)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if targetsErrResp != nil {
+		return []string{fmt.Sprintf("Unable to check the binding in Kubernetes: %s", targetsErrResp.Error())}, nil, nil, nil
+	}
+
+	checkServiceAccount := sa.bindingType() == bindingTypeExisting && sa.tokenType() != tokenTypeCertificate &&
+		!isIdentityTemplate(sa.ServiceAccountName)
+	for _, t := range targets {
+		where := clusterDescription(t.sa.Cluster)
+		clientSet, err := b.clientSet(t.sa.Cluster, t.conn)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("Unable to check the binding in %s: %s", where, err))
+			continue
+		}
+
+		_, err = clientSet.CoreV1().Namespaces().Get(ctx, sa.Namespace, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return nil, created, logical.ErrorResponse(fmt.Sprintf("Namespace '%s' not found in %s", sa.Namespace, where)), nil
+		}
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("Unable to check namespace '%s' in %s: %s", sa.Namespace, where, err))
+			continue
+		}
+
+		if checkServiceAccount {
+			_, err = clientSet.CoreV1().ServiceAccounts(sa.Namespace).Get(ctx, sa.ServiceAccountName, metav1.GetOptions{})
+			switch {
+			case k8serrors.IsNotFound(err) && createIfMissing:
+				if err := b.createBoundServiceAccount(ctx, clientSet, sa); err != nil {
+					return nil, created, nil, errwrap.Wrapf(fmt.Sprintf("Unable to create ServiceAccount '%s/%s' in %s, {{err}}", sa.Namespace, sa.ServiceAccountName, where), err)
+				}
+				created = append(created, t)
+				b.Logger().Info("created ServiceAccount of binding", "binding", sa.Name, "cluster", t.sa.Cluster,
+					"namespace", sa.Namespace, "service-account", sa.ServiceAccountName)
+			case k8serrors.IsNotFound(err):
+				return nil, created, logical.ErrorResponse(fmt.Sprintf("ServiceAccount '%s/%s' not found in %s, create it or set create-if-missing=true",
+					sa.Namespace, sa.ServiceAccountName, where)), nil
+			case err != nil:
+				warnings = append(warnings, fmt.Sprintf("Unable to check ServiceAccount '%s/%s' in %s: %s", sa.Namespace, sa.ServiceAccountName, where, err))
+			}
+		}
+
+		denied, err := checkPermissions(ctx, clientSet, sa.Namespace, requiredPermissions(t.sa))
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", where, err))
+			continue
+		}
+		for _, problem := range denied {
+			warnings = append(warnings, fmt.Sprintf("%s: %s in namespace '%s'", where, problem, sa.Namespace))
+		}
+	}
+	return warnings, created, nil, nil
+}
+
+// createBoundServiceAccount creates ServiceAccount of the existing binding sa. It isn't tied to any lease, so it doesn't
+// get the mount label which tidy looks for and stays when the binding is deleted.
+func (b *kubeBackend) createBoundServiceAccount(ctx context.Context, clientSet *kubernetes.Clientset, sa *ServiceAccount) error {
+	p := &provenance{
+		Labels:      map[string]string{labelManagedBy: "vault"},
+		Annotations: map[string]string{annotationBinding: sa.Name},
+	}
+	_, err := clientSet.CoreV1().ServiceAccounts(sa.Namespace).Create(ctx, &v1.ServiceAccount{
+		ObjectMeta: p.objectMeta(sa.ServiceAccountName, nil),
+	}, metav1.CreateOptions{})
+	return err
+}
+
+// failBindingWrite deletes ServiceAccounts of binding sa which create-if-missing created in targets for a write which
+// failed with errResp or err, and adds the outcome to the failure. The request context may be already cancelled,
+// cleanup must happen anyway.
+func (b *kubeBackend) failBindingWrite(sa *ServiceAccount, targets []fanOutTarget, errResp *logical.Response, err error) (*logical.Response, error) {
+	if len(targets) == 0 {
+		return errResp, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	var failed []string
+	for _, t := range targets {
+		clientSet, err := b.clientSet(t.sa.Cluster, t.conn)
+		if err == nil {
+			err = clientSet.CoreV1().ServiceAccounts(sa.Namespace).Delete(ctx, sa.ServiceAccountName, metav1.DeleteOptions{})
+		}
+		if err != nil && !k8serrors.IsNotFound(err) {
+			b.Logger().Warn("unable to delete ServiceAccount created for failed write of binding", "binding", sa.Name,
+				"cluster", t.sa.Cluster, "error", err)
+			failed = append(failed, clusterDescription(t.sa.Cluster))
+		}
+	}
+	note := fmt.Sprintf("ServiceAccount '%s/%s' created by create-if-missing was deleted", sa.Namespace, sa.ServiceAccountName)
+	if len(failed) > 0 {
+		note = fmt.Sprintf("ServiceAccount '%s/%s' created by create-if-missing couldn't be deleted in %s, delete it by hand",
+			sa.Namespace, sa.ServiceAccountName, strings.Join(failed, ", "))
+	}
+	if errResp != nil {
+		return logical.ErrorResponse(fmt.Sprintf("%s. %s", errResp.Error(), note)), nil
+	}
+	return nil, errwrap.Wrapf(fmt.Sprintf("{{err}}. %s", note), err)
+}
@@ -0,0 +1,316 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestAPIServer starts fake Kubernetes API server, which answers version requests and SelfSubjectAccessReviews
+// with allowed func
+func newTestAPIServer(t *testing.T, allowed func(*authorizationv1.ResourceAttributes) bool) (*httptest.Server, *config) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/version":
+			w.Write([]byte(`{"major": "1", "minor": "22", "gitVersion": "v1.22.1"}`))
+		case "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews":
+			var review authorizationv1.SelfSubjectAccessReview
+			if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			review.Status.Allowed = allowed(review.Spec.ResourceAttributes)
+			json.NewEncoder(w).Encode(&review)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	return server, &config{
+		Token:  "123qwe",
+		APIURL: server.URL,
+		CA:     base64.StdEncoding.EncodeToString(ca),
+	}
+}
+
+func TestVerifyConnection(t *testing.T) {
+	_, c := newTestAPIServer(t, func(attributes *authorizationv1.ResourceAttributes) bool {
+		return !(attributes.Verb == "delete" && attributes.Resource == "secrets")
+	})
+
+	permissions := mountPermissions([]*ServiceAccount{
+		{TokenType: tokenTypeTokenRequest},
+	})
+	assertEquals(t, len(permissions), 5, "Secret permissions and serviceaccounts/token expected")
+
+	problems := verifyConnection(context.Background(), c, permissions)
+	assertEquals(t, len(problems), 1, "")
+	assertEquals(t, problems[0], "not allowed to delete secrets", "")
+
+	c.APIURL = "https://127.0.0.1:1"
+	problems = verifyConnection(context.Background(), c, permissions)
+	assertEquals(t, len(problems), 1, "Unreachable API server should be reported")
+}
+
+func TestRequiredPermissionsDynamic(t *testing.T) {
+	permissions := requiredPermissions(&ServiceAccount{
+		BindingType:   bindingTypeDynamic,
+		ClusterRole:   "view",
+		ClusterScoped: true,
+	})
+	var names []string
+	for _, p := range permissions {
+		names = append(names, p.String())
+	}
+	expected := []string{
+		"create secrets", "list secrets", "watch secrets", "delete secrets",
+		"create serviceaccounts", "delete serviceaccounts",
+		"create clusterrolebindings.rbac.authorization.k8s.io", "delete clusterrolebindings.rbac.authorization.k8s.io",
+	}
+	assertEquals(t, len(names), len(expected), "")
+	for i := range expected {
+		assertEquals(t, names[i], expected[i], "")
+	}
+}
+
+// newTestBindingAPIServer serves namespace 'test' with ServiceAccount 'deploy-bot', ServiceAccounts created or deleted
+// through it are added to or removed from the namespace. SelfSubjectAccessReviews deny deleting secrets. onNamespace, if set, is called before
+// the namespace is returned.
+func newTestBindingAPIServer(t *testing.T, onNamespace func()) *config {
+	var mutex sync.Mutex
+	serviceAccounts := map[string]bool{"deploy-bot": true}
+	c := newTestKubeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/api/v1/namespaces/test" && onNamespace != nil {
+			onNamespace()
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch {
+		case r.URL.Path == "/api/v1/namespaces/test":
+			json.NewEncoder(w).Encode(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test"}})
+		case r.URL.Path == "/api/v1/namespaces/test/serviceaccounts" && r.Method == http.MethodPost:
+			var sa v1.ServiceAccount
+			if err := json.NewDecoder(r.Body).Decode(&sa); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			serviceAccounts[sa.Name] = true
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(&sa)
+		case strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/test/serviceaccounts/"):
+			name := strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/test/serviceaccounts/")
+			if !serviceAccounts[name] {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == http.MethodDelete {
+				delete(serviceAccounts, name)
+				json.NewEncoder(w).Encode(&metav1.Status{Status: metav1.StatusSuccess})
+				return
+			}
+			json.NewEncoder(w).Encode(&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test"}})
+		case r.URL.Path == "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews":
+			var review authorizationv1.SelfSubjectAccessReview
+			if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			attributes := review.Spec.ResourceAttributes
+			review.Status.Allowed = !(attributes.Verb == "delete" && attributes.Resource == "secrets")
+			json.NewEncoder(w).Encode(&review)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return c
+}
+
+func TestVerifyBinding(t *testing.T) {
+	b, s := getTestBackend(t)
+	b.(*kubeBackend).testMode = false
+	assertNoError(t, putConfigEntry(context.Background(), s, ConfigStorageKey, newTestBindingAPIServer(t, nil)))
+
+	write := func(data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "sa/deploy-bot",
+			Data:      data,
+			Storage:   s,
+		})
+	}
+
+	resp, err := write(map[string]interface{}{"namespace": "test", "service-account-name": "deploy-bot"})
+	assertNoError(t, err)
+	if resp == nil || len(resp.Warnings) != 1 || resp.Warnings[0] != "the default cluster: not allowed to delete secrets in namespace 'test'" {
+		t.Fatalf("Denied permission must be returned as a warning, get %#v", resp)
+	}
+
+	resp, err = write(map[string]interface{}{"namespace": "missing", "service-account-name": "deploy-bot"})
+	assertNoError(t, err)
+	if resp == nil || !resp.IsError() || resp.Error().Error() != "Namespace 'missing' not found in the default cluster" {
+		t.Errorf("Missing namespace must fail the write, get %#v", resp)
+	}
+
+	resp, err = write(map[string]interface{}{"namespace": "test", "service-account-name": "deploy-bto"})
+	assertNoError(t, err)
+	if resp == nil || !resp.IsError() || !strings.HasPrefix(resp.Error().Error(), "ServiceAccount 'test/deploy-bto' not found") {
+		t.Errorf("Missing ServiceAccount must fail the write, get %#v", resp)
+	}
+	sa, err := getServiceAccount(context.Background(), "deploy-bot", s)
+	assertNoError(t, err)
+	assertEquals(t, sa.ServiceAccountName, "deploy-bot", "Failed write must not change the binding")
+
+	resp, err = write(map[string]interface{}{"namespace": "test", "service-account-name": "deployer", "create-if-missing": true})
+	assertNoError(t, err)
+	if resp.IsError() {
+		t.Fatalf("ServiceAccount must be created, get %#v", resp)
+	}
+	resp, err = write(map[string]interface{}{"namespace": "test", "service-account-name": "deployer"})
+	assertNoError(t, err)
+	if resp.IsError() {
+		t.Errorf("Created ServiceAccount must be found, get %#v", resp)
+	}
+
+	resp, err = write(map[string]interface{}{"namespace": "missing", "service-account-name": "deploy-bot", "verify-connection": false})
+	assertNoError(t, err)
+	if resp != nil {
+		t.Errorf("Checks must be skipped with verify-connection=false, get %#v", resp)
+	}
+}
+
+func TestVerifyBindingUnlocked(t *testing.T) {
+	b, s := getTestBackend(t)
+	kb := b.(*kubeBackend)
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "sa/deploy-bot",
+		Data:      map[string]interface{}{"namespace": "test", "service-account-name": "deploy-bot"},
+		Storage:   s,
+	})
+	kb.testMode = false
+
+	checking, release := make(chan struct{}), make(chan struct{})
+	var once, releaseOnce sync.Once
+	// Blocked handler would keep the test server from closing on failure
+	unblock := func() { releaseOnce.Do(func() { close(release) }) }
+	defer unblock()
+	assertNoError(t, putConfigEntry(context.Background(), s, ConfigStorageKey, newTestBindingAPIServer(t, func() {
+		once.Do(func() { close(checking) })
+		<-release
+	})))
+
+	result := make(chan *logical.Response)
+	go func() {
+		resp, _ := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "sa/deploy-bot",
+			Data:      map[string]interface{}{"namespace": "test", "ttl": 60},
+			Storage:   s,
+		})
+		result <- resp
+	}()
+	<-checking
+
+	// Creds requests read the binding while it's checked in the cluster
+	read := make(chan struct{})
+	go func() {
+		kb.readServiceAccount(context.Background(), "deploy-bot", s)
+		close(read)
+	}()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Binding must not be locked while it's checked in the cluster")
+	}
+
+	// Another write lands in the meantime
+	sa, err := getServiceAccount(context.Background(), "deploy-bot", s)
+	assertNoError(t, err)
+	sa.ServiceAccountName = "deployer"
+	assertNoError(t, sa.save(context.Background(), s))
+
+	unblock()
+	resp := <-result
+	e := "ServiceAccount 'deploy-bot' was changed by another request while it was checked, retry the write"
+	if resp == nil || !resp.IsError() || resp.Error().Error() != e {
+		t.Errorf("Error must be '%s', get %#v", e, resp)
+	}
+	sa, err = getServiceAccount(context.Background(), "deploy-bot", s)
+	assertNoError(t, err)
+	assertEquals(t, sa.TTL, time.Duration(0), "Binding changed during the check must not be overwritten")
+}
+
+func TestVerifyBindingCreateConflict(t *testing.T) {
+	b, s := getTestBackend(t)
+	kb := b.(*kubeBackend)
+	assertNoErrorRequest(t, b, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "sa/deploy-bot",
+		Data:      map[string]interface{}{"namespace": "test", "service-account-name": "deploy-bot"},
+		Storage:   s,
+	})
+	kb.testMode = false
+
+	checking, release := make(chan struct{}), make(chan struct{})
+	var once, releaseOnce sync.Once
+	unblock := func() { releaseOnce.Do(func() { close(release) }) }
+	defer unblock()
+	assertNoError(t, putConfigEntry(context.Background(), s, ConfigStorageKey, newTestBindingAPIServer(t, func() {
+		once.Do(func() {
+			close(checking)
+			<-release
+		})
+	})))
+
+	write := func(data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "sa/deploy-bot",
+			Data:      data,
+			Storage:   s,
+		})
+		assertNoError(t, err)
+		return resp
+	}
+
+	result := make(chan *logical.Response)
+	go func() {
+		result <- write(map[string]interface{}{"service-account-name": "deployer", "create-if-missing": true})
+	}()
+	<-checking
+
+	// Another write lands while ServiceAccount 'deployer' is created
+	sa, err := getServiceAccount(context.Background(), "deploy-bot", s)
+	assertNoError(t, err)
+	sa.TTL = time.Minute
+	assertNoError(t, sa.save(context.Background(), s))
+
+	unblock()
+	resp := <-result
+	e := "ServiceAccount 'deploy-bot' was changed by another request while it was checked, retry the write. " +
+		"ServiceAccount 'test/deployer' created by create-if-missing was deleted"
+	if resp == nil || !resp.IsError() || resp.Error().Error() != e {
+		t.Fatalf("Error must be '%s', get %#v", e, resp)
+	}
+
+	resp = write(map[string]interface{}{"service-account-name": "deployer"})
+	if resp == nil || !resp.IsError() || !strings.HasPrefix(resp.Error().Error(), "ServiceAccount 'test/deployer' not found") {
+		t.Errorf("ServiceAccount of the binding which wasn't stored must be deleted, get %#v", resp)
+	}
+}
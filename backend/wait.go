@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	watchtools "k8s.io/client-go/tools/watch"
+)
+
+// errWaitTimeout is returned by waitForObject when the condition didn't hold in time, callers explain what was awaited
+var errWaitTimeout = errors.New("timed out waiting for the object")
+
+type listFunc func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error)
+type watchFunc func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error)
+
+// waitForObject returns the object named name once condition holds for it. The object is listed first, so a condition
+// which already holds returns right away, and then watched from the listed version. Waiting stops after timeout with
+// errWaitTimeout or as soon as ctx is cancelled with its error.
+func waitForObject(ctx context.Context, timeout time.Duration, name string, list listFunc, watchObject watchFunc,
+	condition func(object runtime.Object) (bool, error)) (runtime.Object, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	options := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String()}
+	for {
+		object, resourceVersion, err := listObject(waitCtx, list, options, name, condition)
+		if err != nil || object != nil {
+			return object, waitError(ctx, waitCtx, err)
+		}
+
+		options.ResourceVersion = resourceVersion
+		watcher, err := watchObject(waitCtx, options)
+		if err != nil {
+			return nil, waitError(ctx, waitCtx, err)
+		}
+		event, err := watchtools.UntilWithoutRetry(waitCtx, watcher, func(event watch.Event) (bool, error) {
+			switch event.Type {
+			case watch.Deleted:
+				return false, fmt.Errorf("'%s' was deleted", name)
+			case watch.Error:
+				return false, k8serrors.FromObject(event.Object)
+			}
+			return condition(event.Object)
+		})
+		// API server closes watches from time to time, list again to catch up
+		if err == watchtools.ErrWatchClosed {
+			continue
+		}
+		if err != nil {
+			return nil, waitError(ctx, waitCtx, err)
+		}
+		return event.Object, nil
+	}
+}
+
+// listObject returns the object named name if condition already holds for it, otherwise resource version to watch from
+func listObject(ctx context.Context, list listFunc, options metav1.ListOptions, name string,
+	condition func(object runtime.Object) (bool, error)) (runtime.Object, string, error) {
+	listed, err := list(ctx, options)
+	if err != nil {
+		return nil, "", err
+	}
+	items, err := meta.ExtractList(listed)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(items) == 0 {
+		return nil, "", fmt.Errorf("'%s' not found", name)
+	}
+	for _, item := range items {
+		ok, err := condition(item)
+		if err != nil || ok {
+			return item, "", err
+		}
+	}
+	resourceVersion, err := meta.NewAccessor().ResourceVersion(listed)
+	return nil, resourceVersion, err
+}
+
+// waitError tells timeout of waitCtx from cancellation of the request context ctx
+func waitError(ctx, waitCtx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == wait.ErrWaitTimeout || waitCtx.Err() != nil {
+		return errWaitTimeout
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// newTestWatchAPIServer serves Secret 'vault-test' in namespace test without a token. Watches get the token after
+// populateAfter, or never if it's 0.
+func newTestWatchAPIServer(t *testing.T, populateAfter time.Duration) *config {
+	c := newTestKubeServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/api/v1/namespaces/test/secrets" || !strings.Contains(r.URL.Query().Get("fieldSelector"), "vault-test") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		secret := v1.Secret{
+			TypeMeta:   metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{Name: "vault-test", Namespace: "test", ResourceVersion: "1"},
+		}
+		if r.URL.Query().Get("watch") != "true" {
+			json.NewEncoder(w).Encode(&v1.SecretList{ListMeta: metav1.ListMeta{ResourceVersion: "1"}, Items: []v1.Secret{secret}})
+			return
+		}
+		w.(http.Flusher).Flush()
+		if populateAfter == 0 {
+			<-r.Context().Done()
+			return
+		}
+		time.Sleep(populateAfter)
+		secret.ResourceVersion = "2"
+		secret.Data = map[string][]byte{"token": []byte("populated")}
+		object, _ := json.Marshal(&secret)
+		json.NewEncoder(w).Encode(&metav1.WatchEvent{Type: string(watch.Modified), Object: runtime.RawExtension{Raw: object}})
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	return c
+}
+
+func TestWaitForSecretToken(t *testing.T) {
+	clientSet, err := getClientSet(newTestWatchAPIServer(t, 100*time.Millisecond))
+	assertNoError(t, err)
+
+	started := time.Now()
+	secret, err := waitForSecretToken(context.Background(), clientSet, "test", "vault-test", 5*time.Second)
+	assertNoError(t, err)
+	assertEquals(t, string(secret.Data["token"]), "populated", "")
+	if time.Since(started) > 2*time.Second {
+		t.Errorf("Token must be returned as soon as it's populated, waited %s", time.Since(started))
+	}
+
+	clientSet, err = getClientSet(newTestWatchAPIServer(t, 0))
+	assertNoError(t, err)
+
+	_, err = waitForSecretToken(context.Background(), clientSet, "test", "vault-test", 200*time.Millisecond)
+	e := "token of Secret 'test/vault-test' was not populated in 200ms, check that its ServiceAccount exists and the token controller is running"
+	if err == nil || err.Error() != e {
+		t.Errorf("Error must be '%s', get '%v'", e, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = waitForSecretToken(ctx, clientSet, "test", "vault-test", time.Minute)
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("Cancelled request must stop waiting, get '%v'", err)
+	}
+
+	_, err = waitForSecretToken(context.Background(), clientSet, "test", "unknown", time.Second)
+	if err == nil {
+		t.Errorf("Missing Secret must be reported")
+	}
+}